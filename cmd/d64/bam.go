@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math"
+	"os"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	bamFlags      flag.FlagSet
+	bamFormatFlag = bamFlags.String("format", "ansi", "output format: ansi, text, png or svg")
+	bamOutFlag    = bamFlags.String("o", "", "write the map to a file instead of stdout")
+)
+
+func bamUsage() {
+	fmt.Fprintf(bamFlags.Output(), "usage: %s bam [-format ansi|text|png|svg] [-o out] <image.d64>\n", self)
+	bamFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// The size of a block in the png and svg maps, in pixels.
+const (
+	cellSize = 14
+	cellGap  = 2
+)
+
+var (
+	freeColor     = color.RGBA{0x30, 0x30, 0x30, 0xFF}
+	systemColor   = color.RGBA{0xA0, 0xA0, 0xA0, 0xFF}
+	unownedColor  = color.RGBA{0x60, 0x60, 0x60, 0xFF}
+	mismatchColor = color.RGBA{0xFF, 0x20, 0x20, 0xFF}
+)
+
+// blockMap is the block map of an image with a colour and a label for each
+// file.
+type blockMap struct {
+	blocks [][]disk.BlockUse
+	files  []*disk.DirEntry
+	colors map[*disk.DirEntry]color.RGBA
+	labels map[*disk.DirEntry]byte
+}
+
+const labelChars = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
+
+func newBlockMap(d *disk.Img) *blockMap {
+	m := &blockMap{
+		blocks: d.BlockMap(),
+		colors: make(map[*disk.DirEntry]color.RGBA),
+		labels: make(map[*disk.DirEntry]byte),
+	}
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() || ent.BlockCount() == 0 && ent.FileType.Base() == disk.DEL {
+			continue
+		}
+		i := len(m.files)
+		m.files = append(m.files, ent)
+		// step around the colour wheel by the golden angle so neighbouring
+		// files get different colours
+		m.colors[ent] = hsv(math.Mod(float64(i)*137.508, 360), 0.65, 0.95)
+		m.labels[ent] = labelChars[i%len(labelChars)]
+	}
+	return m
+}
+
+// hsv converts a hue in degrees, a saturation and a value to a colour.
+func hsv(h, s, v float64) color.RGBA {
+	c := v * s
+	x := c * (1 - math.Abs(math.Mod(h/60, 2)-1))
+	var r, g, b float64
+	switch {
+	case h < 60:
+		r, g = c, x
+	case h < 120:
+		r, g = x, c
+	case h < 180:
+		g, b = c, x
+	case h < 240:
+		g, b = x, c
+	case h < 300:
+		r, b = x, c
+	default:
+		r, b = c, x
+	}
+	m := v - c
+	return color.RGBA{uint8((r + m) * 255), uint8((g + m) * 255), uint8((b + m) * 255), 0xFF}
+}
+
+// cell returns the colour and label of a block.
+func (m *blockMap) cell(u *disk.BlockUse) (color.RGBA, byte) {
+	switch {
+	case u.Owner != nil:
+		return m.colors[u.Owner], m.labels[u.Owner]
+	case u.System:
+		return systemColor, '#'
+	case !u.Free:
+		return unownedColor, '?'
+	}
+	return freeColor, '.'
+}
+
+// describe says what a block is used for, for the legends and tooltips.
+func describe(u *disk.BlockUse) string {
+	var s string
+	switch {
+	case u.Owner != nil:
+		s = fmt.Sprintf("%q", printable(trimPad(u.Owner.Filename[:])))
+	case u.System:
+		s = "BAM/directory"
+	case !u.Free:
+		s = "allocated, not used by any file"
+	default:
+		s = "free"
+	}
+	switch {
+	case u.Shared:
+		s += ", shared by several files"
+	case u.Used() && u.Free:
+		s += ", marked free in the BAM"
+	}
+	return s
+}
+
+// bam draws the blocks of an image as a grid with a row for each track.
+func bam(args []string) int {
+	bamFlags.Usage = bamUsage
+	bamFlags.Init("bam", flag.ExitOnError)
+	bamFlags.Parse(args)
+	if bamFlags.NArg() != 1 {
+		bamUsage()
+	}
+	log.SetPrefix("bam: ")
+	d, err := readImage(bamFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	out := io.Writer(os.Stdout)
+	if *bamOutFlag != "" {
+		f, err := os.Create(*bamOutFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		out = f
+	}
+	w := bufio.NewWriter(out)
+	m := newBlockMap(d)
+	switch *bamFormatFlag {
+	case "ansi":
+		m.writeText(w, true)
+	case "text":
+		m.writeText(w, false)
+	case "png":
+		err = png.Encode(w, m.image())
+	case "svg":
+		m.writeSVG(w)
+	default:
+		bamUsage()
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+// writeText draws a label for each block, on the colour of its file when ansi
+// is set. Blocks where the BAM disagrees with the chains are marked with '!'
+// in place of the space after the label.
+func (m *blockMap) writeText(w io.Writer, ansi bool) {
+	fmt.Fprint(w, "   ")
+	for s := 0; s < 21; s++ {
+		fmt.Fprintf(w, "%2d ", s)
+	}
+	fmt.Fprintln(w)
+	for t, track := range m.blocks {
+		fmt.Fprintf(w, "%2d ", t+1)
+		for i := range track {
+			u := &track[i]
+			c, label := m.cell(u)
+			mark := byte(' ')
+			if u.Mismatch() {
+				mark = '!'
+			}
+			if ansi {
+				fg := 30
+				if u.Mismatch() {
+					fg = 91
+				}
+				fmt.Fprintf(w, "\x1b[%d;48;2;%d;%d;%dm %c\x1b[0m%c", fg, c.R, c.G, c.B, label, mark)
+			} else {
+				fmt.Fprintf(w, " %c%c", label, mark)
+			}
+		}
+		fmt.Fprintln(w)
+	}
+
+	fmt.Fprintln(w)
+	for _, ent := range m.files {
+		c := m.colors[ent]
+		name := printable(trimPad(ent.Filename[:]))
+		if ansi {
+			fmt.Fprintf(w, "\x1b[30;48;2;%d;%d;%dm %c \x1b[0m %q\n", c.R, c.G, c.B, m.labels[ent], name)
+		} else {
+			fmt.Fprintf(w, " %c  %q\n", m.labels[ent], name)
+		}
+	}
+	fmt.Fprintln(w, " #  BAM and directory")
+	fmt.Fprintln(w, " ?  allocated, not used by any file")
+	fmt.Fprintln(w, " .  free")
+	fmt.Fprintln(w, " !  the BAM disagrees with the chains")
+}
+
+// image draws a square for each block. Blocks where the BAM disagrees with the
+// chains get a red border.
+func (m *blockMap) image() image.Image {
+	img := image.NewRGBA(image.Rect(0, 0, 21*cellSize, len(m.blocks)*cellSize))
+	for t, track := range m.blocks {
+		for s := range track {
+			u := &track[s]
+			c, _ := m.cell(u)
+			x0, y0 := s*cellSize, t*cellSize
+			for y := 0; y < cellSize-cellGap; y++ {
+				for x := 0; x < cellSize-cellGap; x++ {
+					border := x < 2 || y < 2 || x >= cellSize-cellGap-2 || y >= cellSize-cellGap-2
+					if border && u.Mismatch() {
+						img.Set(x0+x, y0+y, mismatchColor)
+					} else {
+						img.Set(x0+x, y0+y, c)
+					}
+				}
+			}
+		}
+	}
+	return img
+}
+
+// writeSVG draws a square for each block with a tooltip, then a legend of the
+// files.
+func (m *blockMap) writeSVG(w io.Writer) {
+	const left, top = 3 * cellSize, cellSize
+	width := left + 21*cellSize + 16*cellSize
+	height := top + len(m.blocks)*cellSize
+	if h := top + (len(m.files)+4)*cellSize; h > height {
+		height = h
+	}
+	fmt.Fprintf(w, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" font-family="monospace" font-size="%d">`+"\n", width, height, cellSize-4)
+	for s := 0; s < 21; s++ {
+		fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="middle">%d</text>`+"\n", left+s*cellSize+cellSize/2, top-3, s)
+	}
+	for t, track := range m.blocks {
+		y := top + t*cellSize
+		fmt.Fprintf(w, `<text x="%d" y="%d" text-anchor="end">%d</text>`+"\n", left-4, y+cellSize-4, t+1)
+		for s := range track {
+			u := &track[s]
+			c, _ := m.cell(u)
+			stroke := ""
+			if u.Mismatch() {
+				stroke = ` stroke="#ff2020" stroke-width="2"`
+			}
+			fmt.Fprintf(w, `<rect x="%d" y="%d" width="%d" height="%d" fill="#%02x%02x%02x"%s><title>%d/%d: %s</title></rect>`+"\n",
+				left+s*cellSize, y, cellSize-cellGap, cellSize-cellGap, c.R, c.G, c.B, stroke, t+1, s, html.EscapeString(describe(u)))
+		}
+	}
+
+	x := left + 22*cellSize
+	legend := func(i int, c color.RGBA, text string) {
+		y := top + i*cellSize
+		fmt.Fprintf(w, `<rect x="%d" y="%d" width="%d" height="%d" fill="#%02x%02x%02x"/>`+"\n", x, y, cellSize-cellGap, cellSize-cellGap, c.R, c.G, c.B)
+		fmt.Fprintf(w, `<text x="%d" y="%d">%s</text>`+"\n", x+cellSize+4, y+cellSize-4, html.EscapeString(text))
+	}
+	for i, ent := range m.files {
+		legend(i, m.colors[ent], printable(trimPad(ent.Filename[:])))
+	}
+	n := len(m.files)
+	legend(n, systemColor, "BAM and directory")
+	legend(n+1, unownedColor, "allocated, not used by any file")
+	legend(n+2, freeColor, "free")
+	legend(n+3, mismatchColor, "the BAM disagrees with the chains")
+	fmt.Fprintln(w, "</svg>")
+}
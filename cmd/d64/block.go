@@ -0,0 +1,242 @@
+package main
+
+import (
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+const blockLen = 256
+
+var (
+	blockReadFlags  flag.FlagSet
+	blockRawFlag    = blockReadFlags.Bool("raw", false, "only print the hexdump")
+	blockWriteFlags flag.FlagSet
+	blockOffFlag    = blockWriteFlags.Int("off", 0, "offset in the block of the first byte to write")
+	blockHexFlag    = blockWriteFlags.String("hex", "", "bytes to write in hexadecimal, spaces allowed")
+	blockFileFlag   = blockWriteFlags.String("file", "", "file holding the bytes to write")
+)
+
+func blockUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s b[lock] read [-raw] <image.d64> T S\n", self)
+	fmt.Fprintf(os.Stderr, "       %s b[lock] write [-off N] <-hex BYTES | -file PATH> <image.d64> T S\n", self)
+	os.Exit(2)
+}
+
+func chainUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s chain <image.d64> T S\n", self)
+	os.Exit(2)
+}
+
+// block runs the subcommands that read and patch single blocks.
+func block(args []string) int {
+	if len(args) < 1 {
+		blockUsage()
+	}
+	switch args[0] {
+	case "read":
+		return blockRead(args[1:])
+	case "write":
+		return blockWrite(args[1:])
+	}
+	blockUsage()
+	return 2
+}
+
+// imageBlock loads the image and parses the track and sector of the
+// arguments.
+func imageBlock(args []string) (*disk.Img, disk.TS) {
+	d, err := readImage(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	ts, err := parseTS(args[1] + "," + args[2])
+	if err != nil {
+		log.Fatalf("%s %s: %v", args[1], args[2], err)
+	}
+	return d, ts
+}
+
+// blockRead prints a hexdump of a block, followed by its fields when the block
+// is the BAM, part of the directory or part of a file.
+func blockRead(args []string) int {
+	blockReadFlags.Usage = blockUsage
+	blockReadFlags.Init("block read", flag.ExitOnError)
+	blockReadFlags.Parse(args)
+	if blockReadFlags.NArg() != 3 {
+		blockUsage()
+	}
+	log.SetPrefix("block read: ")
+	d, ts := imageBlock(blockReadFlags.Args())
+
+	buf := (*[blockLen]byte)(d.Block(ts))
+	hexdump(buf[:])
+	if !*blockRawFlag {
+		fmt.Println()
+		decodeBlock(d, ts)
+	}
+	return 0
+}
+
+// hexdump prints 16 bytes per line with their PETSCII on the side.
+func hexdump(buf []byte) {
+	for off := 0; off < len(buf); off += 16 {
+		fmt.Println(hexLine(buf, off))
+	}
+}
+
+// hexLine formats the 16 bytes of buf at off as a line of a hexdump.
+func hexLine(buf []byte, off int) string {
+	line := buf[off : off+16]
+	text := make([]byte, len(line))
+	for i, c := range line {
+		if c < 0x20 || c >= 0x7F && c != 0xA0 {
+			c = '.'
+		}
+		text[i] = c
+	}
+	return fmt.Sprintf("%02x: % x  |%s|", off, line, printable(text))
+}
+
+// decodeBlock prints the fields of the structure a block holds, found from
+// the directory.
+func decodeBlock(d *disk.Img, ts disk.TS) {
+	u := &d.BlockMap()[ts.T-1][ts.S]
+	if u.Shared {
+		fmt.Println("warning: the block is used by several chains")
+	}
+	if u.Mismatch() && !u.Shared {
+		fmt.Println("warning: the BAM disagrees with the chains")
+	}
+	switch {
+	case ts == (disk.TS{T: 18, S: 0}):
+		decodeBAM(d.BAM())
+	case u.System:
+		decodeDir((*disk.DirBlock)(d.Block(ts)))
+	case u.Owner != nil && u.Owner.FileTS == ts && u.Owner.FileType.Base() == disk.PRG:
+		fmt.Printf("first block of %q\n", printable(trimPad(u.Owner.Filename[:])))
+		prg := (*disk.PrgBlock)(d.Block(ts))
+		decodeLink(prg.Link, prg.Len())
+		fmt.Printf("load address: $%02X%02X\n", prg.LoadHi, prg.LoadLo)
+	case u.Owner != nil:
+		fmt.Printf("block of %q\n", printable(trimPad(u.Owner.Filename[:])))
+		raw := (*disk.RawBlock)(d.Block(ts))
+		decodeLink(raw.Link, raw.Len())
+	case u.Free:
+		fmt.Println("free block")
+	default:
+		fmt.Println("allocated block, not used by any file")
+	}
+}
+
+func decodeLink(link disk.TS, n uint8) {
+	if link.T == 0 {
+		fmt.Printf("last block: %d bytes\n", n)
+	} else {
+		fmt.Printf("next block: %d/%d\n", link.T, link.S)
+	}
+}
+
+func decodeBAM(bam *disk.BAM) {
+	fmt.Println("BAM")
+	fmt.Printf("directory:   %d/%d\n", bam.DirTS.T, bam.DirTS.S)
+	fmt.Printf("format:      $%02X\n", bam.DriveFormat)
+	fmt.Printf("name:        %q\n", printable(trimPad(bam.DiskName[:])))
+	fmt.Printf("id:          %q\n", printable(bam.DiskID[:2]))
+	fmt.Printf("dos type:    %q\n", printable(bam.DOSVersion[:2]))
+	fmt.Printf("blocks free: %d\n", bam.BlocksFree())
+	for t := uint8(1); t <= uint8(len(bam.AvailMap)); t++ {
+		var free strings.Builder
+		for s := uint8(0); s < disk.SectorCount(t); s++ {
+			if bam.Avail(disk.TS{T: t, S: s}) {
+				free.WriteByte('.')
+			} else {
+				free.WriteByte('x')
+			}
+		}
+		fmt.Printf("  track %2d: %2d free %s\n", t, bam.TrackFree(t), free.String())
+	}
+}
+
+func decodeDir(dir *disk.DirBlock) {
+	fmt.Println("directory block")
+	if next, ok := dir.Next(); ok {
+		fmt.Printf("next block: %d/%d\n", next.T, next.S)
+	} else {
+		fmt.Println("last block")
+	}
+	for i := range dir.Files {
+		ent := &dir.Files[i]
+		if ent.IsScratched() && ent.FileTS.T == 0 {
+			fmt.Printf("  %d: empty\n", i)
+			continue
+		}
+		fmt.Printf("  %d: $%02X %s %-18q %5d blocks at %d/%d\n", i, uint8(ent.FileType), ent.FileType,
+			printable(trimPad(ent.Filename[:])), ent.BlockCount(), ent.FileTS.T, ent.FileTS.S)
+	}
+}
+
+// blockWrite patches bytes of a block.
+func blockWrite(args []string) int {
+	blockWriteFlags.Usage = blockUsage
+	blockWriteFlags.Init("block write", flag.ExitOnError)
+	blockWriteFlags.Parse(args)
+	if blockWriteFlags.NArg() != 3 || (*blockHexFlag == "") == (*blockFileFlag == "") {
+		blockUsage()
+	}
+	log.SetPrefix("block write: ")
+	d, ts := imageBlock(blockWriteFlags.Args())
+
+	var data []byte
+	var err error
+	if *blockHexFlag != "" {
+		data, err = hex.DecodeString(strings.Join(strings.Fields(*blockHexFlag), ""))
+	} else {
+		data, err = os.ReadFile(*blockFileFlag)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *blockOffFlag < 0 || *blockOffFlag+len(data) > blockLen {
+		log.Fatalf("%d bytes at offset %d do not fit in a block", len(data), *blockOffFlag)
+	}
+	buf := (*[blockLen]byte)(d.Block(ts))
+	copy(buf[*blockOffFlag:], data)
+	if err := writeImage(blockWriteFlags.Arg(0), d); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+// chain prints every block of the chain starting at a block, with the number
+// of bytes it holds.
+func chain(args []string) int {
+	if len(args) != 3 {
+		chainUsage()
+	}
+	log.SetPrefix("chain: ")
+	d, ts := imageBlock(args)
+
+	blocks, err := d.Chain(ts)
+	for i, ts := range blocks {
+		raw := (*disk.RawBlock)(d.Block(ts))
+		fmt.Printf("%4d  %2d/%-2d  %3d bytes\n", i, ts.T, ts.S, raw.Len())
+	}
+	if err != nil {
+		last := (*disk.RawBlock)(d.Block(blocks[len(blocks)-1])).Link
+		if errors.Is(err, disk.ChainLoop) {
+			log.Printf("%v: links back to %d/%d", err, last.T, last.S)
+		} else {
+			log.Printf("%v: links to %d/%d", err, last.T, last.S)
+		}
+		return 1
+	}
+	fmt.Printf("%d blocks\n", len(blocks))
+	return 0
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	buildFlags   flag.FlagSet
+	buildOutFlag = buildFlags.String("o", "", "output image, instead of the manifest's output or its name with .d64")
+)
+
+func buildUsage() {
+	fmt.Fprintf(buildFlags.Output(), "usage: %s build [-o out.d64] <manifest.json>\n", self)
+	buildFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// build makes an image from a JSON manifest. Source files are found relative
+// to the directory of the manifest.
+func build(args []string) int {
+	buildFlags.Usage = buildUsage
+	buildFlags.Init("build", flag.ExitOnError)
+	buildFlags.Parse(args)
+	if buildFlags.NArg() != 1 {
+		buildUsage()
+	}
+	log.SetPrefix("build: ")
+
+	manifest := buildFlags.Arg(0)
+	buf, err := os.ReadFile(manifest)
+	if err != nil {
+		log.Fatal(err)
+	}
+	spec, err := disk.ParseBuildSpec(buf)
+	if err != nil {
+		log.Fatalf("%s: %v", manifest, err)
+	}
+	dir := filepath.Dir(manifest)
+	d, err := disk.Build(spec, os.DirFS(dir))
+	if err != nil {
+		log.Fatalf("%s: %v", manifest, err)
+	}
+
+	out := *buildOutFlag
+	switch {
+	case out != "":
+	case spec.Output != "":
+		out = filepath.Join(dir, filepath.FromSlash(spec.Output))
+	default:
+		out = strings.TrimSuffix(manifest, filepath.Ext(manifest)) + ".d64"
+	}
+	if err := writeImage(out, d); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	cpFlags       flag.FlagSet
+	cpKeepFlag    = cpFlags.Bool("keep", false, "keep the track and sector of each block when it is free on the destination")
+	cpForceFlag   = cpFlags.Bool("f", false, "replace a file with the same name on the destination")
+	cpProfileFlag = cpFlags.String("profile", "rom", "allocation profile, such as rom, contiguous, fill or il=4")
+)
+
+func cpUsage() {
+	fmt.Fprintf(cpFlags.Output(), "usage: %s cp [-keep] [-f] [-profile rom] <src.d64:NAME> <dst.d64[:NEWNAME]>\n", self)
+	cpFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// splitImageName splits "image.d64:NAME" into the path of the image and the
+// name of the file.
+func splitImageName(arg string) (string, string) {
+	if i := strings.LastIndexByte(arg, ':'); i > 0 {
+		return arg[:i], arg[i+1:]
+	}
+	return arg, ""
+}
+
+// cp copies a file from one image to another without going through the host,
+// keeping its type, flags and the extra blocks of REL and GEOS files.
+func cp(args []string) int {
+	cpFlags.Usage = cpUsage
+	cpFlags.Init("cp", flag.ExitOnError)
+	cpFlags.Parse(args)
+	if cpFlags.NArg() != 2 {
+		cpUsage()
+	}
+	log.SetPrefix("cp: ")
+
+	srcPath, name := splitImageName(cpFlags.Arg(0))
+	dstPath, newName := splitImageName(cpFlags.Arg(1))
+	if name == "" {
+		cpUsage()
+	}
+	profile, err := disk.ParseProfile(*cpProfileFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	src, err := readImage(srcPath)
+	if err != nil {
+		log.Fatal(err)
+	}
+	dst := src
+	if dstPath != srcPath {
+		if dst, err = readImage(dstPath); err != nil {
+			log.Fatal(err)
+		}
+	}
+	opts := &disk.CopyOptions{Name: newName, KeepLayout: *cpKeepFlag, Replace: *cpForceFlag, Strategy: profile}
+	if _, err := disk.CopyFile(dst, src, name, opts); err != nil {
+		log.Fatalf("%s: %v", name, err)
+	}
+	if err := writeImage(dstPath, dst); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
@@ -21,10 +21,12 @@ var (
 	labelFlag   = createFlags.String("lab", "", "disk label for the d64 image")
 	newFileFlag = createFlags.String("f", "", "path to d64 file to create")
 	diskIdFlag  = createFlags.String("id", "", "disk ID (two bytes) in hexadecimal")
+	profileFlag = createFlags.String("profile", "rom", "allocation profile, such as rom, contiguous, fill or il=4")
+	verboseFlag = createFlags.Bool("v", false, "print the interleave each file got")
 )
 
 func createUsage() {
-	fmt.Fprintf(createFlags.Output(), "usage: %s c[reate] <-f dest.d64> <-lab \"disk label\"> [-id 010F] <file1> <file2...>\n", self)
+	fmt.Fprintf(createFlags.Output(), "usage: %s c[reate] <-f dest.d64> <-lab \"disk label\"> [-id 010F] [-profile rom] <file1[@profile]> <file2...>\n", self)
 	createFlags.PrintDefaults()
 	os.Exit(2)
 }
@@ -52,7 +54,7 @@ func create(args []string) int {
 	}
 	diskId, err := hex.DecodeString(*diskIdFlag)
 	if err != nil {
-		log.Fatal("error: bad -id flag: %v", err)
+		log.Fatalf("error: bad -id flag: %v", err)
 	}
 	if len(diskId) != 2 {
 		log.Fatal("error: bad -id flag: must be hexadecimal for two bytes (4 chars)")
@@ -60,14 +62,28 @@ func create(args []string) int {
 
 	log.SetPrefix("create: ")
 
-	if len(inputs) > 1 {
-		log.Fatal("TODO: create is only implemented for a single file")
+	profile, err := disk.ParseProfile(*profileFlag)
+	if err != nil {
+		log.Fatal(err)
 	}
-
 	var bad bool
-	for _, path := range inputs {
-		_, err := os.Stat(path)
-		if err != nil {
+	paths := make([]string, len(inputs))
+	profiles := make([]disk.Profile, len(inputs))
+	for i, input := range inputs {
+		// a profile for a single file follows its path: demo.prg@il=4. An
+		// existing file whose name has an '@' is not split, nor is an '@'
+		// in a directory name.
+		paths[i], profiles[i] = input, profile
+		if j := strings.LastIndex(input, "@"); j >= 0 && !strings.ContainsAny(input[j+1:], `/\`) {
+			if _, err := os.Stat(input); err != nil {
+				paths[i] = input[:j]
+				if profiles[i], err = disk.ParseProfile(input[j+1:]); err != nil {
+					log.Printf("%s: %v", input, err)
+					bad = true
+				}
+			}
+		}
+		if _, err := os.Stat(paths[i]); err != nil {
 			log.Print(err)
 			bad = true
 		}
@@ -77,25 +93,26 @@ func create(args []string) int {
 	}
 
 	var d disk.Img
-	f, err := os.Create(*newFileFlag)
-	if err != nil {
+	if err = d.Init(strings.ToUpper(*labelFlag), string(diskId)); err != nil {
 		log.Fatal(err)
 	}
-	defer f.Close()
-
-	path := inputs[0]
-	buf, err := os.ReadFile(path)
-	if err != nil {
-		log.Fatal(err)
+	for i, path := range paths {
+		buf, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		fname := strings.ToUpper(basename(path))
+		opts := &disk.WriteOptions{Strategy: profiles[i]}
+		if _, err = d.WriteFile(fname, disk.PRG, buf, opts); err != nil {
+			log.Fatalf("%s: %v", path, err)
+		}
 	}
-	fname := basename(path)
-	fname = strings.ToUpper(fname)
-	d.Init(fname, "\x00\x00")
-
-	createFile(fname, buf, &d)
-	if _, err = f.Write(d[:]); err != nil {
+	if err = writeImage(*newFileFlag, &d); err != nil {
 		log.Fatal(err)
 	}
+	if *verboseFlag {
+		printInterleaves(&d)
+	}
 	return 0
 }
 
@@ -109,70 +126,3 @@ func basename(path string) string {
 	}
 	return fname
 }
-
-func createFile(fname string, buf []byte, d *disk.Img) {
-	fname = strings.ToUpper(fname)
-
-	bam := d.BAM()
-
-	a := bam.NewAllocator()
-	ts, err := a.Alloc()
-	if err != nil {
-		log.Fatal(err)
-	}
-	ent, err := d.NewDirEntry()
-	if err != nil {
-		log.Fatal(err)
-	}
-	ent.SetFilename(fname)
-	ent.SetByteLen(len(buf))
-	ent.FileType = disk.PRG
-	ent.FileTS = ts
-
-	if err = writeProgram(d, ts, a, buf); err != nil {
-		log.Fatal(err)
-	}
-}
-
-func writeProgram(d *disk.Img, ts disk.TS, a *disk.Allocator, buf []byte) error {
-	prg := (*disk.PrgBlock)(d.Block(ts))
-	prg.SetLoadAddr(buf[:2])
-	buf = buf[2:]
-	if len(buf) <= 252 {
-		prg.Link.T = 0
-		prg.Link.S = uint8(copy(prg.Data[:], buf))
-		return nil
-	}
-	copy(prg.Data[:], buf[:252])
-	blk := (*disk.RawBlock)(d.Block(ts))
-	return writeRawBlocks(d, blk, a, buf[252:])
-}
-
-func writeRawBlocks(d *disk.Img, blk *disk.RawBlock, a *disk.Allocator, buf []byte) error {
-	if len(buf) == 0 {
-		return nil
-	}
-	var i int
-	var ts disk.TS
-	var err error
-	for {
-		// take the next block from the BAM and link the current block to it
-		ts, err = a.Alloc()
-		if err != nil {
-			return err
-		}
-		blk.Link = ts
-
-		if len(buf)-i <= 254 {
-			// write the last block when there are at most 254 bytes left
-			break
-		}
-		// there are at least 2 more blocks to write
-		blk = (*disk.RawBlock)(d.Block(ts))
-		i += copy(blk.Data[:], buf[i:i+254])
-	}
-
-	tail := (*disk.RawBlock)(d.Block(ts))
-	tail.EndFile(uint8(copy(tail.Data[:], buf[i:])))
-	return nil
-}
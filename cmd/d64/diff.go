@@ -0,0 +1,97 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	diffFlags       flag.FlagSet
+	diffJSONFlag    = diffFlags.Bool("json", false, "print the differences as JSON")
+	diffSectorsFlag = diffFlags.Bool("sectors", false, "print a hexdiff of every block that differs")
+)
+
+func diffUsage() {
+	fmt.Fprintf(diffFlags.Output(), "usage: %s diff [-json] [-sectors] <a.d64> <b.d64>\n", self)
+	diffFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// diff compares two images. Like diff(1), it exits with 1 when they differ.
+func diff(args []string) int {
+	diffFlags.Usage = diffUsage
+	diffFlags.Init("diff", flag.ExitOnError)
+	diffFlags.Parse(args)
+	if diffFlags.NArg() != 2 {
+		diffUsage()
+	}
+	log.SetPrefix("diff: ")
+
+	pa, pb := diffFlags.Arg(0), diffFlags.Arg(1)
+	a, err := readImage(pa)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b, err := readImage(pb)
+	if err != nil {
+		log.Fatal(err)
+	}
+	df, err := disk.Compare(a, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if df.Empty() {
+		return 0
+	}
+	if *diffJSONFlag {
+		printJSON(df)
+		return 1
+	}
+
+	fmt.Printf("--- %s\n+++ %s\n", pa, pb)
+	if len(df.Header) > 0 {
+		fmt.Println("@@ header @@")
+		for _, fd := range df.Header {
+			fmt.Printf("-%s: %s\n+%s: %s\n", fd.Field, fd.Old, fd.Field, fd.New)
+		}
+	}
+	if len(df.Files) > 0 {
+		fmt.Println("@@ files @@")
+		for _, fd := range df.Files {
+			if fd.Path != "" {
+				fmt.Printf("-%s %s %d bytes %.12s\n", fd.Path, fd.Mode, fd.Size, fd.Hash)
+			}
+			if fd.NewPath != "" {
+				fmt.Printf("+%s %s %d bytes %.12s", fd.NewPath, fd.NewMode, fd.NewSize, fd.NewHash)
+				if fd.Op == "renamed" {
+					fmt.Print(" (renamed)")
+				}
+				fmt.Println()
+			}
+		}
+	}
+	if !*diffSectorsFlag {
+		if len(df.Sectors) > 0 {
+			fmt.Printf("@@ %d blocks differ:", len(df.Sectors))
+			for _, ts := range df.Sectors {
+				fmt.Printf(" %d/%d", ts.T, ts.S)
+			}
+			fmt.Println(" @@")
+		}
+		return 1
+	}
+	for _, ts := range df.Sectors {
+		fmt.Printf("@@ block %d/%d @@\n", ts.T, ts.S)
+		ba, bb := (*[blockLen]byte)(a.Block(ts))[:], (*[blockLen]byte)(b.Block(ts))[:]
+		for off := 0; off < blockLen; off += 16 {
+			if la, lb := hexLine(ba, off), hexLine(bb, off); la != lb {
+				fmt.Printf("-%s\n+%s\n", la, lb)
+			}
+		}
+	}
+	return 1
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	dirEditFlags flag.FlagSet
+	dirOutFlag   = dirEditFlags.String("o", "", "write the edited image here instead of over the original")
+	dirListFlags flag.FlagSet
+	dirPrgFlag   = dirListFlags.String("prg", "", "save the listing as the PRG the drive sends for LOAD\"$\",8")
+)
+
+func dirUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s d[ir] edit [-o out.d64] <image.d64> <layout.txt|layout.json>\n", self)
+	fmt.Fprintf(os.Stderr, "       %s d[ir] list [-prg out.prg] <image.d64>\n", self)
+	os.Exit(2)
+}
+
+// dir runs the subcommands that work on the directory of an image.
+func dir(args []string) int {
+	if len(args) < 1 {
+		dirUsage()
+	}
+	switch args[0] {
+	case "edit":
+		return dirEdit(args[1:])
+	case "list":
+		return dirList(args[1:])
+	}
+	dirUsage()
+	return 2
+}
+
+// dirList prints the directory listing of an image the same way as ls, or
+// saves it as a PRG.
+func dirList(args []string) int {
+	dirListFlags.Usage = dirUsage
+	dirListFlags.Init("dir list", flag.ExitOnError)
+	dirListFlags.Parse(args)
+	if dirListFlags.NArg() != 1 {
+		dirUsage()
+	}
+	log.SetPrefix("dir list: ")
+
+	d, err := readImage(dirListFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *dirPrgFlag != "" {
+		if err := os.WriteFile(*dirPrgFlag, d.Listing(), 0644); err != nil {
+			log.Fatal(err)
+		}
+		return 0
+	}
+	printListing(d)
+	return 0
+}
+
+// layoutItem is one line of a layout file. Exactly one field is set.
+type layoutItem struct {
+	// File is the name of a file on the image.
+	File string `json:"file,omitempty"`
+	// Sep is the name of a separator.
+	Sep string `json:"sep,omitempty"`
+	// Hex is the raw PETSCII name of a separator, in hexadecimal.
+	Hex string `json:"hex,omitempty"`
+	// Rest places every file which is not listed elsewhere.
+	Rest bool `json:"rest,omitempty"`
+}
+
+// dirEdit rewrites the directory of an image from a layout file. A text
+// layout has one entry per line:
+//
+//	file NAME    a file already on the image
+//	sep TEXT     a zero block DEL entry named TEXT
+//	hex A0C0C0   a zero block DEL entry with a raw PETSCII name
+//	rest         the files which are not listed anywhere else
+//
+// The text of a separator is the rest of the line after the single space or
+// tab following "sep", so it keeps its leading and trailing spaces. Blank lines
+// and lines starting with '#' are ignored. A JSON layout is an array of objects
+// with one of the keys "file", "sep", "hex" or "rest". Files which are not
+// listed go at the end unless the layout has a rest entry.
+func dirEdit(args []string) int {
+	dirEditFlags.Usage = dirUsage
+	dirEditFlags.Init("dir edit", flag.ExitOnError)
+	dirEditFlags.Parse(args)
+	if dirEditFlags.NArg() != 2 {
+		dirUsage()
+	}
+	log.SetPrefix("dir edit: ")
+
+	path := dirEditFlags.Arg(0)
+	d, err := readImage(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf, err := os.ReadFile(dirEditFlags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	items, err := parseLayout(buf)
+	if err != nil {
+		log.Fatalf("%s: %v", dirEditFlags.Arg(1), err)
+	}
+	ents, err := layoutDirectory(d, items)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := d.SetDirectory(ents); err != nil {
+		log.Fatal(err)
+	}
+	if *dirOutFlag != "" {
+		path = *dirOutFlag
+	}
+	if err := writeImage(path, d); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+func parseLayout(buf []byte) ([]layoutItem, error) {
+	var items []layoutItem
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &items); err != nil {
+			return nil, err
+		}
+		for i, item := range items {
+			if len(item.File) > 16 {
+				return nil, fmt.Errorf("entry %d: file name %q is longer than 16 characters", i+1, item.File)
+			}
+		}
+		return items, nil
+	}
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for n := 1; sc.Scan(); n++ {
+		raw := strings.TrimLeft(strings.TrimSuffix(sc.Text(), "\r"), " \t")
+		line := strings.TrimSpace(raw)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		key, val := line, ""
+		if i := strings.IndexAny(line, " \t"); i >= 0 {
+			key, val = line[:i], strings.TrimLeft(line[i:], " \t")
+		}
+		var item layoutItem
+		switch key {
+		case "file":
+			if len(val) > 16 {
+				return nil, fmt.Errorf("line %d: file name %q is longer than 16 characters", n, val)
+			}
+			item.File = val
+		case "sep":
+			// dir art depends on the spaces, so only the one after the
+			// key is dropped
+			item.Sep = raw[len(key):]
+			if item.Sep != "" {
+				item.Sep = item.Sep[1:]
+			}
+		case "hex":
+			item.Hex = strings.ReplaceAll(val, " ", "")
+		case "rest":
+			item.Rest = true
+		default:
+			return nil, fmt.Errorf("line %d: unknown entry %q", n, key)
+		}
+		items = append(items, item)
+	}
+	return items, sc.Err()
+}
+
+// layoutDirectory builds the new directory from the layout and the entries of
+// the files on the image.
+func layoutDirectory(d *disk.Img, items []layoutItem) ([]disk.DirEntry, error) {
+	var files []disk.DirEntry
+	for _, ent := range d.Directory() {
+		// the old separators are replaced by the ones in the layout
+		if ent.FileType.Base() != disk.DEL || ent.BlockCount() != 0 {
+			files = append(files, ent)
+		}
+	}
+	listed := make([]bool, len(files))
+	find := func(name string) (int, error) {
+		padded := disk.PadString(name, 16)
+		for i, ent := range files {
+			if bytes.Equal(ent.Filename[:], padded) {
+				if listed[i] {
+					return 0, fmt.Errorf("%s: listed twice", name)
+				}
+				return i, nil
+			}
+		}
+		return 0, fmt.Errorf("%s: %w", name, disk.FileNotFound)
+	}
+
+	var ents []disk.DirEntry
+	rest := -1
+	for _, item := range items {
+		var (
+			ent disk.DirEntry
+			err error
+		)
+		switch {
+		case item.File != "":
+			var i int
+			if i, err = find(item.File); err == nil {
+				ent, listed[i] = files[i], true
+			}
+		case item.Sep != "":
+			ent, err = disk.Separator([]byte(item.Sep))
+		case item.Hex != "":
+			var name []byte
+			if name, err = hex.DecodeString(item.Hex); err == nil {
+				ent, err = disk.Separator(name)
+			}
+		case item.Rest:
+			rest = len(ents)
+			continue
+		default:
+			err = fmt.Errorf("empty layout entry")
+		}
+		if err != nil {
+			return nil, err
+		}
+		ents = append(ents, ent)
+	}
+
+	var unlisted []disk.DirEntry
+	for i, ent := range files {
+		if !listed[i] {
+			unlisted = append(unlisted, ent)
+		}
+	}
+	if rest < 0 {
+		return append(ents, unlisted...), nil
+	}
+	return append(ents[:rest], append(unlisted, ents[rest:]...)...), nil
+}
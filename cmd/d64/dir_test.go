@@ -0,0 +1,27 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseLayout(t *testing.T) {
+	items, err := parseLayout([]byte("# art\nfile INTRO\nsep   -= DEMO =-  \n  sep\t*\r\nhex A0 C0\nrest\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []layoutItem{{File: "INTRO"}, {Sep: "  -= DEMO =-  "}, {Sep: "*"}, {Hex: "A0C0"}, {Rest: true}}
+	if !reflect.DeepEqual(items, want) {
+		t.Errorf("got %+v", items)
+	}
+
+	for _, layout := range []string{
+		"rest\nfile SEVENTEEN CHARSXX\n",
+		"rest\nnope\n",
+	} {
+		if _, err := parseLayout([]byte(layout)); err == nil || !strings.HasPrefix(err.Error(), "line 2:") {
+			t.Errorf("%q: got error %v", layout, err)
+		}
+	}
+}
@@ -1,11 +1,75 @@
 package main
 
 import (
+	"flag"
 	"fmt"
+	"io/fs"
+	"log"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	extractFlags flag.FlagSet
+	outDirFlag   = extractFlags.String("d", ".", "directory to extract the files into")
 )
 
+func extractUsage() {
+	fmt.Fprintf(extractFlags.Output(), "usage: %s x[extract] [-d dir] <image.d64> [PATTERN...]\n", self)
+	extractFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// extract copies the files matching the CBM patterns, or every file, out of the
+// image.
 func extract(args []string) int {
-	fmt.Fprintln(os.Stderr, "extract not implemented yet")
-	return 2
+	extractFlags.Usage = extractUsage
+	extractFlags.Init("extract", flag.ExitOnError)
+	extractFlags.Parse(args)
+	if extractFlags.NArg() < 1 {
+		extractUsage()
+	}
+	log.SetPrefix("extract: ")
+
+	d, err := readImage(extractFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	patterns := extractFlags.Args()[1:]
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+
+	diskfs := d.FS(disk.CBMGlob())
+	root, err := fs.ReadDir(diskfs, ".")
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := 0
+	for _, pattern := range patterns {
+		names, err := fs.Glob(diskfs, path.Join(root[0].Name(), strings.ToUpper(pattern)))
+		if err == nil && len(names) == 0 {
+			err = fs.ErrNotExist
+		}
+		if err != nil {
+			log.Printf("%s: %v", pattern, err)
+			code = 1
+			continue
+		}
+		for _, name := range names {
+			buf, err := fs.ReadFile(diskfs, name)
+			if err != nil {
+				log.Fatal(err)
+			}
+			dest := filepath.Join(*outDirFlag, path.Base(name))
+			if err = os.WriteFile(dest, buf, 0644); err != nil {
+				log.Fatal(err)
+			}
+		}
+	}
+	return code
 }
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	importFlags        flag.FlagSet
+	importProfileFlag  = importFlags.String("profile", "rom", "allocation profile, such as rom, contiguous, fill or il=4")
+	importManifestFlag = importFlags.String("manifest", "", "file in the directory listing the files to import first, in order")
+	importVerboseFlag  = importFlags.Bool("v", false, "print the name each file got")
+)
+
+func importUsage() {
+	fmt.Fprintf(importFlags.Output(), "usage: %s import [-profile rom] [-manifest FILE] [-v] <image.d64> <dir>\n", self)
+	importFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// importDir copies every file of a host directory tree onto an image. The
+// image is left as it was if any file does not fit.
+func importDir(args []string) int {
+	importFlags.Usage = importUsage
+	importFlags.Init("import", flag.ExitOnError)
+	importFlags.Parse(args)
+	if importFlags.NArg() != 2 {
+		importUsage()
+	}
+	log.SetPrefix("import: ")
+
+	profile, err := disk.ParseProfile(*importProfileFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	path := importFlags.Arg(0)
+	d, err := readImage(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := &disk.ImportOptions{Manifest: *importManifestFlag, Strategy: profile}
+	ents, err := disk.ImportFS(d, os.DirFS(importFlags.Arg(1)), opts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := writeImage(path, d); err != nil {
+		log.Fatal(err)
+	}
+	if *importVerboseFlag {
+		for _, ent := range ents {
+			fmt.Printf("%-5d%-18q %s\n", ent.BlockCount(), printable(trimPad(ent.Filename[:])), ent.FileType)
+		}
+	}
+	return 0
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+// interleave reports the interleave of every file on an image.
+func interleave(args []string) int {
+	if len(args) != 1 {
+		fmt.Fprintf(os.Stderr, "usage: %s i[nterleave] <image.d64>\n", self)
+		os.Exit(2)
+	}
+	log.SetPrefix("interleave: ")
+	d, err := readImage(args[0])
+	if err != nil {
+		log.Fatal(err)
+	}
+	printInterleaves(d)
+	return 0
+}
+
+// printInterleaves prints one line per file with its size, the number of
+// tracks it spans and how often each gap between sectors occurs.
+func printInterleaves(d *disk.Img) {
+	for _, il := range d.Interleaves() {
+		var gaps []int
+		for gap := range il.Gaps {
+			gaps = append(gaps, gap)
+		}
+		sort.Slice(gaps, func(i, j int) bool {
+			return il.Gaps[gaps[i]] > il.Gaps[gaps[j]] ||
+				il.Gaps[gaps[i]] == il.Gaps[gaps[j]] && gaps[i] < gaps[j]
+		})
+		var parts []string
+		for _, gap := range gaps {
+			parts = append(parts, fmt.Sprintf("%dx%d", gap, il.Gaps[gap]))
+		}
+		fmt.Printf("%-18q %4d blocks %2d tracks  %s\n", il.Name, il.Blocks, il.Tracks, strings.Join(parts, " "))
+	}
+}
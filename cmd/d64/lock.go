@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+func lockUsage(locked bool) {
+	cmd := "l[ock]"
+	if !locked {
+		cmd = "unl[ock]"
+	}
+	fmt.Fprintf(os.Stderr, "usage: %s %s <image.d64> <PATTERN...>\n", self, cmd)
+	os.Exit(2)
+}
+
+// lock sets or clears the lock flag of the files matching each CBM pattern.
+func lock(args []string, locked bool) int {
+	if len(args) < 2 {
+		lockUsage(locked)
+	}
+	if locked {
+		log.SetPrefix("lock: ")
+	} else {
+		log.SetPrefix("unlock: ")
+	}
+
+	path := args[0]
+	d, err := readImage(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	code := 0
+	for _, pattern := range args[1:] {
+		ents, err := d.Glob(strings.ToUpper(pattern))
+		if err == nil && len(ents) == 0 {
+			err = disk.FileNotFound
+		}
+		if err != nil {
+			log.Printf("%s: %v", pattern, err)
+			code = 1
+		}
+		for _, ent := range ents {
+			ent.FileType = ent.FileType.Set(disk.FlagLocked, locked)
+		}
+	}
+	if code != 0 {
+		return code
+	}
+	if err = writeImage(path, d); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	lsFlags      flag.FlagSet
+	lsJSONFlag   = lsFlags.Bool("json", false, "print JSON instead of a listing")
+	infoFlags    flag.FlagSet
+	infoJSONFlag = infoFlags.Bool("json", false, "print JSON instead of text")
+)
+
+func lsUsage() {
+	fmt.Fprintf(lsFlags.Output(), "usage: %s ls [--json] <image.d64>\n", self)
+	lsFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+func infoUsage() {
+	fmt.Fprintf(infoFlags.Output(), "usage: %s info [--json] <image.d64>\n", self)
+	infoFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// printable converts PETSCII to text for the terminal. Shifted spaces become
+// spaces and bytes outside of printable ASCII become '?'. Names written by
+// this tool from lowercase ASCII keep their case.
+func printable(buf []byte) string {
+	var sb strings.Builder
+	for _, c := range buf {
+		switch {
+		case c == 0xA0:
+			sb.WriteByte(' ')
+		case c >= 0x20 && c < 0x7F:
+			sb.WriteByte(c)
+		default:
+			sb.WriteByte('?')
+		}
+	}
+	return sb.String()
+}
+
+// trimPad removes the shifted spaces which pad a name.
+func trimPad(buf []byte) []byte {
+	return bytes.TrimRight(buf, "\xa0")
+}
+
+// The JSON schemas of ls and info. Fields are only ever added.
+type (
+	lsJSON struct {
+		Name       string     `json:"name"`
+		ID         string     `json:"id"`
+		Files      []fileJSON `json:"files"`
+		BlocksFree int        `json:"blocks_free"`
+	}
+	fileJSON struct {
+		Name string `json:"name"`
+		// RawName is the padded PETSCII name in hexadecimal.
+		RawName string `json:"raw_name"`
+		Type    string `json:"type"`
+		Blocks  int    `json:"blocks"`
+		Closed  bool   `json:"closed"`
+		Locked  bool   `json:"locked"`
+		Track   int    `json:"track"`
+		Sector  int    `json:"sector"`
+	}
+	infoJSON struct {
+		Name       string      `json:"name"`
+		ID         string      `json:"id"`
+		DOSType    string      `json:"dos_type"`
+		Format     int         `json:"format"`
+		BlocksFree int         `json:"blocks_free"`
+		Tracks     []trackJSON `json:"tracks"`
+		Directory  []tsJSON    `json:"directory"`
+	}
+	trackJSON struct {
+		Track   int `json:"track"`
+		Sectors int `json:"sectors"`
+		Free    int `json:"free"`
+	}
+	tsJSON struct {
+		Track  int `json:"track"`
+		Sector int `json:"sector"`
+	}
+)
+
+func printJSON(v interface{}) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(v); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// ls prints the directory of an image the way the 1541 lists it.
+func ls(args []string) int {
+	lsFlags.Usage = lsUsage
+	lsFlags.Init("ls", flag.ExitOnError)
+	lsFlags.Parse(args)
+	if lsFlags.NArg() != 1 {
+		lsUsage()
+	}
+	log.SetPrefix("ls: ")
+	d, err := readImage(lsFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !*lsJSONFlag {
+		printListing(d)
+		return 0
+	}
+
+	bam := d.BAM()
+	out := lsJSON{
+		Name:       printable(trimPad(bam.DiskName[:])),
+		ID:         printable(bam.DiskID[:2]),
+		Files:      []fileJSON{},
+		BlocksFree: int(bam.BlocksFree()),
+	}
+	for _, ent := range d.Directory() {
+		out.Files = append(out.Files, fileJSON{
+			Name:    printable(trimPad(ent.Filename[:])),
+			RawName: hex.EncodeToString(ent.Filename[:]),
+			Type:    ent.FileType.Base().String(),
+			Blocks:  int(ent.BlockCount()),
+			Closed:  ent.FileType.Closed(),
+			Locked:  ent.FileType.Locked(),
+			Track:   int(ent.FileTS.T),
+			Sector:  int(ent.FileTS.S),
+		})
+	}
+	printJSON(out)
+	return 0
+}
+
+// printListing prints the listing as LIST shows it once it is loaded.
+func printListing(d *disk.Img) {
+	text := d.ListingText()
+	for _, line := range bytes.Split(bytes.TrimSuffix(text, []byte{'\r'}), []byte{'\r'}) {
+		// drop the reverse video of the header
+		fmt.Println(printable(bytes.ReplaceAll(line, []byte{0x12}, nil)))
+	}
+}
+
+// info prints the header of an image, the free blocks on each track and the
+// blocks of the directory.
+func info(args []string) int {
+	infoFlags.Usage = infoUsage
+	infoFlags.Init("info", flag.ExitOnError)
+	infoFlags.Parse(args)
+	if infoFlags.NArg() != 1 {
+		infoUsage()
+	}
+	log.SetPrefix("info: ")
+	d, err := readImage(infoFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bam := d.BAM()
+	out := infoJSON{
+		Name:       printable(trimPad(bam.DiskName[:])),
+		ID:         printable(bam.DiskID[:2]),
+		DOSType:    printable(bam.DOSVersion[:2]),
+		Format:     int(bam.DriveFormat),
+		BlocksFree: int(bam.BlocksFree()),
+		Directory:  []tsJSON{},
+	}
+	for t := uint8(1); t <= uint8(len(bam.AvailMap)); t++ {
+		out.Tracks = append(out.Tracks, trackJSON{int(t), int(disk.SectorCount(t)), int(bam.TrackFree(t))})
+	}
+	chain, err := d.Chain(bam.DirTS)
+	for _, ts := range chain {
+		out.Directory = append(out.Directory, tsJSON{int(ts.T), int(ts.S)})
+	}
+	if err != nil {
+		log.Printf("directory: %v", err)
+	}
+	if *infoJSONFlag {
+		printJSON(out)
+		return 0
+	}
+
+	fmt.Printf("name:        %q\n", out.Name)
+	fmt.Printf("id:          %q\n", out.ID)
+	fmt.Printf("dos type:    %q\n", out.DOSType)
+	fmt.Printf("format:      $%02X\n", out.Format)
+	fmt.Printf("blocks free: %d\n", out.BlocksFree)
+	var dir []string
+	for _, ts := range out.Directory {
+		dir = append(dir, fmt.Sprintf("%d/%d", ts.Track, ts.Sector))
+	}
+	fmt.Printf("directory:   %s\n", strings.Join(dir, " "))
+	fmt.Println("track  free")
+	for _, tr := range out.Tracks {
+		fmt.Printf("   %2d  %2d/%d\n", tr.Track, tr.Free, tr.Sectors)
+	}
+	return 0
+}
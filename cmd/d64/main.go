@@ -2,9 +2,12 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"strings"
+
+	"github.com/juster/c64/disk"
 )
 
 const (
@@ -16,7 +19,7 @@ var (
 )
 
 func usage() {
-	log.Printf("usage: %s [Create/eXtract/Help]", self)
+	log.Printf("usage: %s [Create/eXtract/Undelete/Lock/UNLock/Interleave/Timing/Optimize/Dir/LS/INFO/BAM/Block/CHAIN/Shell/IMPORT/BUILD/DIFF/PATCH/CP/Help]", self)
 	os.Exit(2)
 }
 
@@ -33,8 +36,63 @@ func main() {
 		code = create(os.Args[2:])
 	case "x", "extract":
 		code = extract(os.Args[2:])
+	case "u", "undelete":
+		code = undelete(os.Args[2:])
+	case "l", "lock":
+		code = lock(os.Args[2:], true)
+	case "unl", "unlock":
+		code = lock(os.Args[2:], false)
+	case "i", "interleave":
+		code = interleave(os.Args[2:])
+	case "t", "timing":
+		code = timing(os.Args[2:])
+	case "o", "optimize":
+		code = optimize(os.Args[2:])
+	case "d", "dir":
+		code = dir(os.Args[2:])
+	case "ls":
+		code = ls(os.Args[2:])
+	case "info":
+		code = info(os.Args[2:])
+	case "bam":
+		code = bam(os.Args[2:])
+	case "b", "block":
+		code = block(os.Args[2:])
+	case "chain":
+		code = chain(os.Args[2:])
+	case "s", "shell":
+		code = shell(os.Args[2:])
+	case "import":
+		code = importDir(os.Args[2:])
+	case "build":
+		code = build(os.Args[2:])
+	case "diff":
+		code = diff(os.Args[2:])
+	case "patch":
+		code = patch(os.Args[2:])
+	case "cp":
+		code = cp(os.Args[2:])
 	default:
 		usage()
 	}
 	os.Exit(code)
 }
+
+// readImage loads a d64 file from the host file system.
+func readImage(path string) (*disk.Img, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	d := new(disk.Img)
+	if len(buf) != len(d) {
+		return nil, fmt.Errorf("%s: not a d64 image: %d bytes", path, len(buf))
+	}
+	copy(d[:], buf)
+	return d, nil
+}
+
+// writeImage saves a d64 image to the host file system.
+func writeImage(path string, d *disk.Img) error {
+	return os.WriteFile(path, d[:], 0644)
+}
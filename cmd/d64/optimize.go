@@ -0,0 +1,58 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	optimizeFlags  flag.FlagSet
+	optProfileFlag = optimizeFlags.String("profile", "rom", "allocation profile, such as rom, contiguous, fill or il=4")
+	optOutFlag     = optimizeFlags.String("o", "", "write the optimized image here instead of over the original")
+	optVerboseFlag = optimizeFlags.Bool("v", false, "print the interleave each file got")
+)
+
+func optimizeUsage() {
+	fmt.Fprintf(optimizeFlags.Output(), "usage: %s o[ptimize] [-profile rom] [-o out.d64] [-v] <image.d64>\n", self)
+	optimizeFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// optimize rewrites every file on an image with the chosen profile and
+// compacts the directory.
+func optimize(args []string) int {
+	optimizeFlags.Usage = optimizeUsage
+	optimizeFlags.Init("optimize", flag.ExitOnError)
+	optimizeFlags.Parse(args)
+	if optimizeFlags.NArg() != 1 {
+		optimizeUsage()
+	}
+	log.SetPrefix("optimize: ")
+
+	profile, err := disk.ParseProfile(*optProfileFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	path := optimizeFlags.Arg(0)
+	d, err := readImage(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := d.Optimize(profile); err != nil {
+		log.Fatal(err)
+	}
+	if *optOutFlag != "" {
+		path = *optOutFlag
+	}
+	if err := writeImage(path, d); err != nil {
+		log.Fatal(err)
+	}
+	if *optVerboseFlag {
+		printInterleaves(d)
+	}
+	return 0
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	patchCreateFlags flag.FlagSet
+	patchFormatFlag  = patchCreateFlags.String("format", "d64", "patch format: d64, ips or bps")
+	patchApplyFlags  flag.FlagSet
+	patchOutFlag     = patchApplyFlags.String("o", "", "write the patched image here instead of over the original")
+	patchForceFlag   = patchApplyFlags.Bool("force", false, "apply IPS patches, which cannot be checked against the image")
+)
+
+func patchUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s patch create [-format d64|ips|bps] <old.d64> <new.d64> > patch\n", self)
+	fmt.Fprintf(os.Stderr, "       %s patch apply [-o out.d64] [-force] <image.d64> <patch>\n", self)
+	os.Exit(2)
+}
+
+// patch runs the subcommands that make and apply patches.
+func patch(args []string) int {
+	if len(args) < 1 {
+		patchUsage()
+	}
+	switch args[0] {
+	case "create":
+		return patchCreate(args[1:])
+	case "apply":
+		return patchApply(args[1:])
+	}
+	patchUsage()
+	return 2
+}
+
+// patchCreate writes the patch from one image to another to stdout.
+func patchCreate(args []string) int {
+	patchCreateFlags.Usage = patchUsage
+	patchCreateFlags.Init("patch create", flag.ExitOnError)
+	patchCreateFlags.Parse(args)
+	if patchCreateFlags.NArg() != 2 {
+		patchUsage()
+	}
+	log.SetPrefix("patch create: ")
+
+	old, err := readImage(patchCreateFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	to, err := readImage(patchCreateFlags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := disk.MakePatch(old, to)
+	var buf []byte
+	switch *patchFormatFlag {
+	case "d64":
+		buf = p.Bytes()
+	case "ips":
+		buf = p.IPS()
+	case "bps":
+		if buf, err = p.BPS(old); err != nil {
+			log.Fatal(err)
+		}
+	default:
+		log.Fatalf("unknown format %q", *patchFormatFlag)
+	}
+	if _, err := os.Stdout.Write(buf); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+// patchApply applies a patch in any of the formats to an image. The image is
+// left alone when a d64 or BPS patch was made from another one. An IPS patch
+// has no checksums, so nothing tells whether it fits the image, and it is only
+// applied with -force.
+func patchApply(args []string) int {
+	patchApplyFlags.Usage = patchUsage
+	patchApplyFlags.Init("patch apply", flag.ExitOnError)
+	patchApplyFlags.Parse(args)
+	if patchApplyFlags.NArg() != 2 {
+		patchUsage()
+	}
+	log.SetPrefix("patch apply: ")
+
+	path := patchApplyFlags.Arg(0)
+	d, err := readImage(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	buf, err := os.ReadFile(patchApplyFlags.Arg(1))
+	if err != nil {
+		log.Fatal(err)
+	}
+	var p *disk.Patch
+	switch {
+	case disk.IsPatch(buf):
+		p, err = disk.ParsePatch(buf)
+	case disk.IsIPS(buf):
+		if !*patchForceFlag {
+			log.Fatalf("%s: IPS patches cannot be checked against the image; use -force to apply it anyway", patchApplyFlags.Arg(1))
+		}
+		p, err = disk.ParseIPS(buf, d)
+	case disk.IsBPS(buf):
+		p, err = disk.ParseBPS(buf, d)
+	default:
+		log.Fatalf("%s: unknown patch format", patchApplyFlags.Arg(1))
+	}
+	if err == nil {
+		err = p.Apply(d)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *patchOutFlag != "" {
+		path = *patchOutFlag
+	}
+	if err := writeImage(path, d); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
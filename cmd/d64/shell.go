@@ -0,0 +1,446 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+// maxUndo is the number of changes the shell can undo.
+const maxUndo = 50
+
+func shellUsage() {
+	fmt.Fprintf(os.Stderr, "usage: %s s[hell] <image.d64>\n", self)
+	os.Exit(2)
+}
+
+// session is the state of the shell: the open image, the state it was in when
+// it was last saved and the states it can go back to.
+type session struct {
+	path  string
+	d     *disk.Img
+	dos   *disk.DOS
+	saved disk.Img
+	undo  []disk.Img
+}
+
+func (s *session) dirty() bool {
+	return *s.d != s.saved
+}
+
+// open replaces the image of the session.
+func (s *session) open(path string) error {
+	d, err := readImage(path)
+	if err != nil {
+		return err
+	}
+	s.path, s.d, s.dos, s.saved, s.undo = path, d, disk.NewDOS(d), *d, nil
+	return nil
+}
+
+func (s *session) write(path string) error {
+	if path == "" {
+		path = s.path
+	}
+	if err := writeImage(path, s.d); err != nil {
+		return err
+	}
+	s.path, s.saved = path, *s.d
+	return nil
+}
+
+// shellCmd is a command of the shell. Commands which change the image can be
+// undone.
+type shellCmd struct {
+	run     func(s *session, args []string) error
+	changes bool
+	usage   string
+}
+
+var shellCmds map[string]shellCmd
+
+func init() {
+	shellCmds = map[string]shellCmd{
+		"ls":       {shellLs, false, "ls [PATTERN]          list the directory"},
+		"cd":       {shellCd, false, "cd [-f] IMAGE         open another image, -f drops unsaved changes"},
+		"cat":      {shellCat, false, "cat [-r] NAME         print a file as text, -r prints the raw bytes"},
+		"get":      {shellGet, false, "get NAME [PATH]       copy a file to the host"},
+		"put":      {shellPut, true, "put [-t TYPE] PATH [NAME]  copy a host file to the image"},
+		"rm":       {shellRm, true, "rm PATTERN...         scratch files"},
+		"mv":       {shellMv, true, "mv OLD NEW            rename a file"},
+		"lock":     {shellLock(true), true, "lock PATTERN...       lock files"},
+		"unlock":   {shellLock(false), true, "unlock PATTERN...     unlock files"},
+		"validate": {shellValidate, true, "validate              rebuild the BAM"},
+		"block":    {shellBlock, false, "block T S             show a block"},
+		"dos":      {shellDOS, true, "dos COMMAND           send a command to the drive, also @COMMAND"},
+		"undo":     {shellUndo, false, "undo                  undo the last change"},
+		"write":    {shellWrite, false, "write [PATH]          save the image"},
+		"quit":     {nil, false, "quit [-f]             save and leave, -f drops unsaved changes"},
+		"help":     {shellHelp, false, "help                  list the commands"},
+	}
+}
+
+// shell runs commands on an image until the input ends or quit.
+func shell(args []string) int {
+	if len(args) != 1 {
+		shellUsage()
+	}
+	s := new(session)
+	if err := s.open(args[0]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+
+	in := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Printf("%s> ", filepath.Base(s.path))
+		if !in.Scan() {
+			fmt.Println()
+			break
+		}
+		line := strings.TrimSpace(in.Text())
+		if strings.HasPrefix(line, "@") {
+			line = "dos " + line[1:]
+		}
+		words, err := splitWords(line)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			continue
+		}
+		if len(words) == 0 {
+			continue
+		}
+		if words[0] == "quit" || words[0] == "exit" {
+			if len(words) > 1 && words[1] == "-f" {
+				return 0
+			}
+			break
+		}
+		cmd, ok := shellCmds[words[0]]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "error: unknown command %q, try help\n", words[0])
+			continue
+		}
+		before := *s.d
+		err = cmd.run(s, words[1:])
+		if cmd.changes && *s.d != before {
+			s.undo = append(s.undo, before)
+			if len(s.undo) > maxUndo {
+				s.undo = s.undo[1:]
+			}
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+		}
+	}
+	if err := in.Err(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+	if s.dirty() {
+		if err := s.write(""); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// splitWords splits a command line at spaces. Double quotes keep spaces in a
+// word.
+func splitWords(line string) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord, quoted := false, false
+	for _, r := range line {
+		switch {
+		case r == '"':
+			quoted, inWord = !quoted, true
+		case (r == ' ' || r == '\t') && !quoted:
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if quoted {
+		return nil, errors.New("missing closing quote")
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+func wantArgs(args []string, min, max int) error {
+	if len(args) < min || max >= 0 && len(args) > max {
+		return errors.New("wrong number of arguments, try help")
+	}
+	return nil
+}
+
+// lookup finds a file by name, ignoring case like the rest of the shell.
+func lookup(d *disk.Img, name string) (*disk.DirEntry, error) {
+	ent := d.Lookup(strings.ToUpper(name))
+	if ent == nil {
+		ent = d.Lookup(name)
+	}
+	if ent == nil {
+		return nil, fmt.Errorf("%s: %w", name, disk.FileNotFound)
+	}
+	return ent, nil
+}
+
+// glob matches a CBM pattern, and fails when nothing matches.
+func glob(d *disk.Img, pattern string) ([]*disk.DirEntry, error) {
+	ents, err := d.Glob(strings.ToUpper(pattern))
+	if err == nil && len(ents) == 0 {
+		err = disk.FileNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", pattern, err)
+	}
+	return ents, nil
+}
+
+func shellLs(s *session, args []string) error {
+	if err := wantArgs(args, 0, 1); err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		printListing(s.d)
+		return nil
+	}
+	ents, err := glob(s.d, args[0])
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		fmt.Printf("%-5d%-18q %s\n", ent.BlockCount(), printable(trimPad(ent.Filename[:])), ent.FileType)
+	}
+	return nil
+}
+
+func shellCd(s *session, args []string) error {
+	force := len(args) > 0 && args[0] == "-f"
+	if force {
+		args = args[1:]
+	}
+	if err := wantArgs(args, 1, 1); err != nil {
+		return err
+	}
+	if s.dirty() && !force {
+		return errors.New("the image has unsaved changes, write first or use cd -f")
+	}
+	return s.open(args[0])
+}
+
+// petsciiText converts PETSCII text, as written in the lowercase character
+// set, to ASCII.
+func petsciiText(buf []byte) []byte {
+	out := make([]byte, 0, len(buf))
+	for _, c := range buf {
+		switch {
+		case c == '\r':
+			c = '\n'
+		case c >= 0x41 && c <= 0x5A:
+			c += 'a' - 'A'
+		case c >= 0x61 && c <= 0x7A:
+			c -= 'a' - 'A'
+		case c >= 0xC1 && c <= 0xDA:
+			c -= 0x80
+		case c == 0xA0:
+			c = ' '
+		case c < 0x20 || c > 0x7E:
+			c = '.'
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func shellCat(s *session, args []string) error {
+	raw := len(args) > 0 && args[0] == "-r"
+	if raw {
+		args = args[1:]
+	}
+	if err := wantArgs(args, 1, 1); err != nil {
+		return err
+	}
+	ent, err := lookup(s.d, args[0])
+	if err != nil {
+		return err
+	}
+	buf, err := s.d.ReadFile(ent)
+	if err != nil {
+		return err
+	}
+	if !raw {
+		buf = petsciiText(buf)
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			buf = append(buf, '\n')
+		}
+	}
+	_, err = os.Stdout.Write(buf)
+	return err
+}
+
+func shellGet(s *session, args []string) error {
+	if err := wantArgs(args, 1, 2); err != nil {
+		return err
+	}
+	ent, err := lookup(s.d, args[0])
+	if err != nil {
+		return err
+	}
+	buf, err := s.d.ReadFile(ent)
+	if err != nil {
+		return err
+	}
+	path := args[len(args)-1]
+	if len(args) == 1 {
+		path = strings.ToLower(fmt.Sprintf("%s.%s", ent.FilenameString(), ent.FileType.Base()))
+	}
+	return os.WriteFile(path, buf, 0644)
+}
+
+func shellPut(s *session, args []string) error {
+	typ := disk.PRG
+	if len(args) > 1 && args[0] == "-t" {
+		var err error
+		if typ, err = disk.ParseFileType(args[1]); err != nil {
+			return err
+		}
+		args = args[2:]
+	}
+	if err := wantArgs(args, 1, 2); err != nil {
+		return err
+	}
+	buf, err := os.ReadFile(args[0])
+	if err != nil {
+		return err
+	}
+	name := args[len(args)-1]
+	if len(args) == 1 {
+		name = filepath.Base(name)
+		name = strings.ToUpper(strings.TrimSuffix(name, filepath.Ext(name)))
+	}
+	_, err = s.d.WriteFile(name, typ, buf, nil)
+	return err
+}
+
+func shellRm(s *session, args []string) error {
+	if err := wantArgs(args, 1, -1); err != nil {
+		return err
+	}
+	for _, pattern := range args {
+		ents, err := glob(s.d, pattern)
+		if err != nil {
+			return err
+		}
+		for _, ent := range ents {
+			if err := s.d.Remove(ent.FilenameString(), false); err != nil {
+				return fmt.Errorf("%s: %w", ent.FilenameString(), err)
+			}
+		}
+	}
+	return nil
+}
+
+func shellMv(s *session, args []string) error {
+	if err := wantArgs(args, 2, 2); err != nil {
+		return err
+	}
+	ent, err := lookup(s.d, args[0])
+	if err != nil {
+		return err
+	}
+	return s.d.Rename(ent.FilenameString(), strings.ToUpper(args[1]))
+}
+
+func shellLock(locked bool) func(*session, []string) error {
+	return func(s *session, args []string) error {
+		if err := wantArgs(args, 1, -1); err != nil {
+			return err
+		}
+		for _, pattern := range args {
+			ents, err := glob(s.d, pattern)
+			if err != nil {
+				return err
+			}
+			for _, ent := range ents {
+				ent.FileType = ent.FileType.Set(disk.FlagLocked, locked)
+			}
+		}
+		return nil
+	}
+}
+
+func shellValidate(s *session, args []string) error {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return err
+	}
+	return s.d.Validate()
+}
+
+func shellBlock(s *session, args []string) error {
+	if err := wantArgs(args, 2, 2); err != nil {
+		return err
+	}
+	ts, err := parseTS(args[0] + "," + args[1])
+	if err != nil {
+		return err
+	}
+	hexdump((*[blockLen]byte)(s.d.Block(ts))[:])
+	fmt.Println()
+	decodeBlock(s.d, ts)
+	return nil
+}
+
+func shellDOS(s *session, args []string) error {
+	if err := wantArgs(args, 1, -1); err != nil {
+		return err
+	}
+	fmt.Println(s.dos.Command(strings.ToUpper(strings.Join(args, " "))))
+	return nil
+}
+
+func shellUndo(s *session, args []string) error {
+	if err := wantArgs(args, 0, 0); err != nil {
+		return err
+	}
+	if len(s.undo) == 0 {
+		return errors.New("nothing to undo")
+	}
+	*s.d = s.undo[len(s.undo)-1]
+	s.undo = s.undo[:len(s.undo)-1]
+	return nil
+}
+
+func shellWrite(s *session, args []string) error {
+	if err := wantArgs(args, 0, 1); err != nil {
+		return err
+	}
+	path := ""
+	if len(args) == 1 {
+		path = args[0]
+	}
+	return s.write(path)
+}
+
+func shellHelp(s *session, args []string) error {
+	for _, name := range []string{"ls", "cd", "cat", "get", "put", "rm", "mv", "lock", "unlock",
+		"validate", "block", "dos", "undo", "write", "quit", "help"} {
+		fmt.Println(shellCmds[name].usage)
+	}
+	fmt.Println("A 1541 disk has no partitions, so cd only opens other images.")
+	return nil
+}
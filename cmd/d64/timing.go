@@ -0,0 +1,77 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	timingFlags flag.FlagSet
+	costFlag    = timingFlags.Duration("cost", disk.DefaultTiming.BlockCost, "time the loader spends on each block")
+	stepFlag    = timingFlags.Duration("step", disk.DefaultTiming.StepTime, "time the head takes to move one track")
+	rpmFlag     = timingFlags.Float64("rpm", disk.DefaultTiming.RPM, "rotation speed of the disk")
+	tracksFlag  = timingFlags.Bool("tracks", false, "print the revolutions spent on each track")
+)
+
+func timingUsage() {
+	fmt.Fprintf(timingFlags.Output(), "usage: %s t[iming] [-cost 25ms] [-step 12ms] [-rpm 300] [-tracks] <image.d64> [PATTERN...]\n", self)
+	timingFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+// timing estimates the time it takes to load each file matching the CBM
+// patterns.
+func timing(args []string) int {
+	timingFlags.Usage = timingUsage
+	timingFlags.Init("timing", flag.ExitOnError)
+	timingFlags.Parse(args)
+	if timingFlags.NArg() < 1 {
+		timingUsage()
+	}
+	log.SetPrefix("timing: ")
+	if !(*rpmFlag > 0) {
+		log.Fatalf("invalid RPM: %v", *rpmFlag)
+	}
+
+	d, err := readImage(timingFlags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	patterns := timingFlags.Args()[1:]
+	if len(patterns) == 0 {
+		patterns = []string{"*"}
+	}
+	model := disk.TimingModel{RPM: *rpmFlag, StepTime: *stepFlag, BlockCost: *costFlag}
+	code := 0
+	for _, pattern := range patterns {
+		ents, err := d.Glob(strings.ToUpper(pattern))
+		if err == nil && len(ents) == 0 {
+			err = disk.FileNotFound
+		}
+		if err != nil {
+			log.Printf("%s: %v", pattern, err)
+			code = 1
+			continue
+		}
+		for _, ent := range ents {
+			tm, err := model.File(d, ent)
+			if err != nil {
+				log.Printf("%s: %v", ent.FilenameString(), err)
+				code = 1
+				continue
+			}
+			fmt.Printf("%-18q %4d blocks %8.3fs\n", ent.FilenameString(), tm.Blocks, tm.Total.Seconds())
+			if *tracksFlag {
+				for _, tt := range tm.Tracks {
+					fmt.Printf("    track %2d: %2d blocks %5.2f revolutions\n", tt.Track, tt.Blocks, tt.Revolutions)
+				}
+			}
+		}
+	}
+	return code
+}
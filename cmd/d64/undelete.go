@@ -0,0 +1,123 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/juster/c64/disk"
+)
+
+var (
+	undeleteFlags flag.FlagSet
+	restoreFlag   = undeleteFlags.String("r", "", "CBM pattern of the scratched files to restore")
+	adoptFlag     = undeleteFlags.String("adopt", "", "track,sector of an orphan chain to give a new directory entry named by -r")
+	typeFlag      = undeleteFlags.String("t", "", "file type of the restored file (default: guessed)")
+)
+
+func undeleteUsage() {
+	fmt.Fprintf(undeleteFlags.Output(), "usage: %s u[ndelete] [-r PATTERN [-t PRG] [-adopt T,S]] <image.d64>\n", self)
+	undeleteFlags.PrintDefaults()
+	os.Exit(2)
+}
+
+func undelete(args []string) int {
+	undeleteFlags.Usage = undeleteUsage
+	undeleteFlags.Init("undelete", flag.ExitOnError)
+	undeleteFlags.Parse(args)
+	if undeleteFlags.NArg() != 1 {
+		undeleteUsage()
+	}
+	log.SetPrefix("undelete: ")
+
+	path := undeleteFlags.Arg(0)
+	d, err := readImage(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var typ disk.FileType
+	if *typeFlag != "" {
+		if typ, err = disk.ParseFileType(*typeFlag); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	switch {
+	case *restoreFlag == "":
+		listRecoverable(d)
+		return 0
+	case *adoptFlag != "":
+		ts, err := parseTS(*adoptFlag)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if _, err = d.Adopt(ts, strings.ToUpper(*restoreFlag), typ); err != nil {
+			log.Fatalf("%v: %v", ts, err)
+		}
+	default:
+		ents, err := findRecoverable(d, strings.ToUpper(*restoreFlag))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(ents) == 0 {
+			log.Fatalf("%s: no recoverable file matches", *restoreFlag)
+		}
+		for _, ent := range ents {
+			if err = d.Undelete(ent, typ); err != nil {
+				log.Fatalf("%s: %v", ent.FilenameString(), err)
+			}
+		}
+	}
+	if err = writeImage(path, d); err != nil {
+		log.Fatal(err)
+	}
+	return 0
+}
+
+func listRecoverable(d *disk.Img) {
+	for _, r := range d.Recoverable() {
+		fmt.Printf("%-5d %-18q %v %d,%d\n", len(r.Blocks), r.Entry.FilenameString(),
+			r.Type, r.Blocks[0].T, r.Blocks[0].S)
+	}
+	for _, chain := range d.Orphans() {
+		fmt.Printf("%-5d %-18s %s %d,%d\n", len(chain), "(orphan)", "???", chain[0].T, chain[0].S)
+	}
+}
+
+func findRecoverable(d *disk.Img, pattern string) ([]*disk.DirEntry, error) {
+	spec, err := disk.ParseOpen(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var ents []*disk.DirEntry
+	for _, r := range d.Recoverable() {
+		if disk.MatchName([]byte(spec.Pattern), r.Entry.Filename) {
+			ents = append(ents, r.Entry)
+		}
+	}
+	return ents, nil
+}
+
+// parseTS parses a track and sector pair written as "T,S" or "T/S".
+func parseTS(s string) (disk.TS, error) {
+	i := strings.IndexAny(s, ",/")
+	if i < 0 {
+		return disk.TS{}, fmt.Errorf("bad track/sector: %s", s)
+	}
+	t, err := strconv.ParseUint(s[:i], 10, 8)
+	if err != nil {
+		return disk.TS{}, fmt.Errorf("bad track: %s", s)
+	}
+	sec, err := strconv.ParseUint(s[i+1:], 10, 8)
+	if err != nil {
+		return disk.TS{}, fmt.Errorf("bad sector: %s", s)
+	}
+	ts := disk.TS{T: uint8(t), S: uint8(sec)}
+	if !ts.IsValid() {
+		return ts, disk.BadTS
+	}
+	return ts, nil
+}
@@ -36,8 +36,17 @@ func (bam *BAM) Init(name, id string) error {
 	if len(id) != 2 {
 		return errors.New("invalid disk id")
 	}
-	var j int
 	bam.DriveFormat = bamDriveFormat1541
+	bam.FreeAll()
+	copy(bam.DiskName[:], PadString(name, 16))
+	copy(bam.DiskID[:], PadString(id, 3))
+	copy(bam.DOSVersion[:], PadString(bamDOSVersion, 6))
+	return nil
+}
+
+// FreeAll marks every block on the disk as available.
+func (bam *BAM) FreeAll() {
+	var j int
 	for i := range bam.AvailMap {
 		if uint8(i + 1) > geometry[j].trackMax {
 			j++
@@ -47,17 +56,13 @@ func (bam *BAM) Init(name, id string) error {
 			bam.AvailMap[i].free[k] = 0xFF
 		}
 	}
-	copy(bam.DiskName[:], PadString(name, 16))
-	copy(bam.DiskID[:], PadString(id, 3))
-	copy(bam.DOSVersion[:], PadString(bamDOSVersion, 6))
-	return nil
 }
 
 func (bam *BAM) Entry(ts TS) *BAMEntry {
-	if int(ts.T) >= len(bam.AvailMap) {
+	if ts.T == 0 || int(ts.T) > len(bam.AvailMap) {
 		return nil
 	}
-	if ts.S >= 32 {
+	if int(ts.S) >= 8 * len(BAMEntry{}.free) {
 		return nil
 	}
 	return &bam.AvailMap[ts.T - 1]
@@ -111,8 +116,66 @@ func (bam *BAM) Avail(ts TS) bool {
 	return ent.free[i] & j > 0
 }
 
+// TrackFree returns the number of free blocks on a track.
+func (bam *BAM) TrackFree(track uint8) uint8 {
+	ent := bam.Entry(TS{track, 0})
+	if ent == nil {
+		return 0
+	}
+	return ent.Count
+}
+
+// BlocksFree returns the number of free blocks the drive reports, which leaves
+// out the directory track.
+func (bam *BAM) BlocksFree() uint16 {
+	var n uint16
+	for t := uint8(1); t <= totalTrackCount; t++ {
+		if t != bamTrack {
+			n += uint16(bam.TrackFree(t))
+		}
+	}
+	return n
+}
+
+// firstFree searches a track for a free block, starting at sector s and
+// wrapping around to sector 0. Returns a null TS if the track is full.
+func (bam *BAM) firstFree(track, s uint8) TS {
+	n := sectorCount(track)
+	for i := uint8(0); i < n; i++ {
+		ts := TS{track, (s + i) % n}
+		if bam.Avail(ts) {
+			return ts
+		}
+	}
+	return TS{}
+}
+
+// staggerSector adds the stagger to a sector. Sectors past the end of the track
+// wrap around the way the DOS does it, which is one sector short of the
+// start of the track.
+func staggerSector(s, stagger, n uint8) uint8 {
+	s += stagger
+	for s >= n {
+		s -= n
+		if s > 0 {
+			s--
+		}
+	}
+	return s
+}
+
 type NextTrackFunc = func (uint8) uint8
 
+// AllocStrategy decides which block an Allocator hands out next.
+type AllocStrategy interface {
+	// First returns the first block of a new file. Returns a null TS when
+	// the disk is full.
+	First(bam *BAM) TS
+	// Next returns the block which follows prev in a file. Returns a null
+	// TS when the disk is full.
+	Next(bam *BAM, prev TS) TS
+}
+
 type Allocator struct {
 	bam *BAM
 	// Lookahead for the next track/sector to attempt to allocate.
@@ -123,6 +186,10 @@ type Allocator struct {
 	SectorStagger uint8
 	// Next available track algorithm may be overridden.
 	NextTrack NextTrackFunc
+	// Strategy replaces the lookahead, stagger and next track fields when
+	// it is set.
+	Strategy AllocStrategy
+	prev TS
 }
 
 // The defaultNextTrack function looks for tracks outside of the BAM (middle)
@@ -153,7 +220,28 @@ func (bam *BAM) NewAllocator() *Allocator {
 	}
 }
 
+// newDirAllocator returns an allocator for the blocks of the directory, which
+// follow the block at ts and never leave the directory track.
+func (bam *BAM) newDirAllocator(ts TS) *Allocator {
+	a := bam.NewAllocator()
+	a.TS = ts
+	a.SectorStagger = SectorDirStagger
+	a.NextTrack = func (_ uint8) uint8 { return 0 }
+	return a
+}
+
+// NewStrategyAllocator returns an allocator which takes its blocks from the
+// given strategy.
+func (bam *BAM) NewStrategyAllocator(strategy AllocStrategy) *Allocator {
+	a := bam.NewAllocator()
+	a.Strategy = strategy
+	return a
+}
+
 func (a *Allocator) Alloc() (TS, error) {
+	if a.Strategy != nil {
+		return a.allocStrategy()
+	}
 	if a.TS.T == 0 {
 		return TS{0, 0}, DiskFull
 	}
@@ -163,7 +251,7 @@ func (a *Allocator) Alloc() (TS, error) {
 		ts = a.nextTS(ts)
 		if ts.T == 0 {
 			a.TS = ts
-			return ts, nil
+			return ts, DiskFull
 		}
 	}
 
@@ -175,6 +263,23 @@ func (a *Allocator) Alloc() (TS, error) {
 	return ts, nil
 }
 
+func (a *Allocator) allocStrategy() (TS, error) {
+	var ts TS
+	if a.prev.IsNull() {
+		ts = a.Strategy.First(a.bam)
+	} else {
+		ts = a.Strategy.Next(a.bam, a.prev)
+	}
+	if ts.IsNull() {
+		return TS{}, DiskFull
+	}
+	if err := a.bam.Alloc(ts); err != nil {
+		return TS{}, err
+	}
+	a.prev = ts
+	return ts, nil
+}
+
 func (a *Allocator) nextTS(ts TS) TS {
 	var next TS
 	for iter := ts; iter.T > 0; iter = next {
@@ -194,18 +299,72 @@ func (a *Allocator) nextTS(ts TS) TS {
 // nextAvailBlock finds the next available block in the same track as ts, starting
 // with ts. Returns TS{0, 0} if no blocks are available on that track.
 func (a *Allocator) nextAvailBlock(ts TS) TS {
-	max := sectorCount(ts.T) - 1
+	if a.bam.Avail(ts) {
+		return ts
+	}
+	n := sectorCount(ts.T)
+	return a.bam.firstFree(ts.T, staggerSector(ts.S, a.SectorStagger, n))
+}
 
-	// Check every sector on the track.
-	for i := uint8(0); i <= max; i++ {
-		if a.bam.Avail(ts) {
-			return ts
+// ROMStrategy allocates blocks exactly like the DOS in the 1541 ROM, so files
+// written with it get the same layout as files saved on a real drive.
+type ROMStrategy struct {
+	// Interleave is the number of sectors skipped between the blocks of a
+	// file. The DOS uses SectorFileStagger.
+	Interleave uint8
+}
+
+// First searches for the track closest to the directory track with a free
+// block, trying the track below before the one above, and takes the first
+// free sector on it.
+func (r ROMStrategy) First(bam *BAM) TS {
+	for dist := uint8(1); dist < totalTrackCount; dist++ {
+		if dist < bamTrack && bam.TrackFree(bamTrack - dist) > 0 {
+			return bam.firstFree(bamTrack - dist, 0)
 		}
-		ts.S += a.SectorStagger
-		if ts.S > max {
-			ts.S = 1 + ts.S % max
+		if bamTrack + dist <= totalTrackCount && bam.TrackFree(bamTrack + dist) > 0 {
+			return bam.firstFree(bamTrack + dist, 0)
 		}
 	}
-	
 	return TS{}
 }
+
+// Next stays on the track of prev and adds the interleave to its sector while
+// the track has free blocks. Otherwise it moves on to the next track away from
+// the directory track. Past the edge of the disk it continues on the other side
+// of the directory track, and when that side is full as well the disk is full.
+func (r ROMStrategy) Next(bam *BAM, prev TS) TS {
+	t := prev.T
+	if bam.TrackFree(t) > 0 {
+		return bam.firstFree(t, staggerSector(prev.S, r.Interleave, sectorCount(t)))
+	}
+	t = romNextTrack(t, func(t uint8) bool { return bam.TrackFree(t) > 0 })
+	if t == 0 {
+		return TS{}
+	}
+	return bam.firstFree(t, 0)
+}
+
+// romNextTrack steps away from the directory track until it finds a track for
+// which ok returns true. Past the edge of the disk it continues on the other
+// side of the directory track, and when that side has nothing either it
+// returns 0.
+func romNextTrack(t uint8, ok func(uint8) bool) uint8 {
+	for wrapped := false; ; {
+		switch {
+		case t < bamTrack && t > 1:
+			t--
+		case t > bamTrack && t < totalTrackCount:
+			t++
+		case wrapped:
+			return 0
+		case t < bamTrack:
+			wrapped, t = true, bamTrack + 1
+		default:
+			wrapped, t = true, bamTrack - 1
+		}
+		if ok(t) {
+			return t
+		}
+	}
+}
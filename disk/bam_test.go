@@ -0,0 +1,197 @@
+package disk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStaggerSector(t *testing.T) {
+	for _, tc := range []struct{ s, stagger, n, want uint8 }{
+		{0, 10, 21, 10},
+		{10, 10, 21, 20},
+		{20, 10, 21, 8},
+		{12, 10, 21, 0},
+		{10, 10, 19, 0},
+		{16, 3, 19, 0},
+	} {
+		if s := staggerSector(tc.s, tc.stagger, tc.n); s != tc.want {
+			t.Errorf("%+v: got %d", tc, s)
+		}
+	}
+}
+
+func TestDefaultAllocatorFillsDisk(t *testing.T) {
+	var d Img
+	d.Init("FULL", "01")
+	a := d.BAM().NewAllocator()
+	n := 0
+	for {
+		_, err := a.Alloc()
+		if err == DiskFull {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		n++
+	}
+	if n != totalBlockCount - int(sectorCount(bamTrack)) {
+		t.Error("allocated the wrong number of blocks:", n)
+	}
+}
+
+// The first three files on the reference image were saved one after the other
+// on an empty disk, so the ROM strategy must lay them out the same way.
+func TestROMStrategyGolden(t *testing.T) {
+	ref := loadTestImage(t)
+	var d Img
+	d.Init("GOLDEN", "01")
+	opts := &WriteOptions{Strategy: ROMStrategy{SectorFileStagger}}
+	for _, ent := range ref.DirEntries()[:3] {
+		data, err := ref.ReadFile(ent)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := ent.FilenameString()
+		got, err := d.WriteFile(name, ent.FileType, data, opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, _ := ref.Chain(ent.FileTS)
+		chain, _ := d.Chain(got.FileTS)
+		if !reflect.DeepEqual(chain, want) {
+			t.Errorf("%s: got chain %v\nexpected %v", name, chain, want)
+		}
+	}
+}
+
+func TestROMStrategyFillsDisk(t *testing.T) {
+	var d Img
+	d.Init("FULL", "01")
+	a := d.BAM().NewStrategyAllocator(ROMStrategy{SectorFileStagger})
+	seen := make(map[TS]bool)
+	for {
+		ts, err := a.Alloc()
+		if err == DiskFull {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		if ts.T == bamTrack || seen[ts] {
+			t.Fatal("bad block:", ts)
+		}
+		seen[ts] = true
+	}
+	if len(seen) != totalBlockCount - int(sectorCount(bamTrack)) {
+		t.Error("allocated the wrong number of blocks:", len(seen))
+	}
+}
+
+func TestProfiles(t *testing.T) {
+	p, err := ParseProfile("fill,il=4,track=3,reserve=5-7,reserve=35")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Profile{"fill,il=4,track=3,reserve=5-7,reserve=35", 4, OrderAscending, 3,
+		[]TrackRange{{5, 7}, {35, 35}}}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("parsed %+v", p)
+	}
+	for _, s := range []string{"il=0", "track=18", "reserve=9-3", "fast"} {
+		if _, err := ParseProfile(s); err == nil {
+			t.Errorf("%s: expected an error", s)
+		}
+	}
+
+	var d Img
+	d.Init("PROFILES", "01")
+	data := make([]byte, 200 * 254)
+	ent, err := d.WriteFile("FILL", PRG, data, &WriteOptions{Strategy: p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain, _ := d.Chain(ent.FileTS)
+	if chain[0] != (TS{3, 0}) || chain[1] != (TS{3, 4}) {
+		t.Error("file did not start on track 3 with an interleave of 4:", chain[:2])
+	}
+	for _, ts := range chain {
+		if ts.T >= 5 && ts.T <= 7 || ts.T == 35 {
+			t.Fatal("allocated a reserved track:", ts)
+		}
+	}
+
+	d.WriteFile("NEXT", PRG, data[:254 * 21], &WriteOptions{Strategy: ProfileContiguous})
+	il := d.Interleaves()[1]
+	if il.Blocks != 21 || il.Tracks != 1 || il.Gaps[1] != 20 {
+		t.Errorf("contiguous file got %+v", il)
+	}
+
+	// "rom" is ROMStrategy, up to and including a full disk
+	var a, b Img
+	a.Init("ROM", "01")
+	b.Init("ROM", "01")
+	for i := 0; ; i++ {
+		name := string(rune('A' + i))
+		_, errA := a.WriteFile(name, PRG, data[:40 * 254], &WriteOptions{Strategy: ProfileROM})
+		_, errB := b.WriteFile(name, PRG, data[:40 * 254], &WriteOptions{Strategy: ROMStrategy{SectorFileStagger}})
+		if errA != errB {
+			t.Fatalf("file %s: profile returned %v, strategy %v", name, errA, errB)
+		}
+		if errA != nil {
+			break
+		}
+	}
+	if a != b {
+		t.Error("ProfileROM and ROMStrategy laid out the disk differently")
+	}
+}
+
+func TestBlockMap(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	ent, _ := d.WriteFile("FILE", SEQ, make([]byte, 1000), nil)
+	chain, _ := d.Chain(ent.FileTS)
+	bam := d.BAM()
+	bam.Free(chain[1])
+	stray := TS{1, 5}
+	bam.Alloc(stray)
+
+	var used, mismatched []TS
+	for _, track := range d.BlockMap() {
+		for _, u := range track {
+			if u.Owner == ent {
+				used = append(used, u.TS)
+			}
+			if u.Mismatch() {
+				mismatched = append(mismatched, u.TS)
+			}
+		}
+	}
+	if len(used) != len(chain) {
+		t.Errorf("expected %d blocks owned by the file, got %v", len(chain), used)
+	}
+	want := []TS{stray, chain[1]}
+	if len(mismatched) != 2 || mismatched[0] != want[0] || mismatched[1] != want[1] {
+		t.Errorf("expected mismatches at %v, got %v", want, mismatched)
+	}
+
+	// side sectors and the blocks of a GEOS file belong to the file
+	var e Img
+	e.Init("TEST", "01")
+	rel, ss := writeREL(t, &e, "RECORDS", make([]byte, 600), 20)
+	a := e.BAM().NewAllocator()
+	info, _ := a.Alloc()
+	index, _ := a.Alloc()
+	rec, _ := e.writeChain(a, []byte("VLIR RECORD"))
+	idx := blockBytes(&e, index)
+	idx[0], idx[1], idx[2], idx[3] = 0, 0xFF, rec[0].T, rec[0].S
+	geos, _ := e.NewDirEntry()
+	*geos = DirEntry{DirLink: geos.DirLink, FileType: USR | FlagClosed, FileTS: index, RelSideSector: info, RelRecordSize: 1,
+		Unused: [4]byte{6, 86, 1, 2}}
+	geos.SetFilename("DESKTOP APP")
+	blocks := e.BlockMap()
+	for _, ts := range append(rel, ss, info, index, rec[0]) {
+		if u := blocks[ts.T - 1][ts.S]; u.Owner == nil || u.Mismatch() {
+			t.Errorf("%v: %+v", ts, u)
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package disk
+
+// BlockUse describes what a block is used for, according to both the BAM and
+// the chains of the directory and the files.
+type BlockUse struct {
+	TS TS
+	// Free is set when the BAM marks the block as available.
+	Free bool
+	// System is set for the BAM and the blocks of the directory.
+	System bool
+	// Owner is the directory entry of the file that holds the block.
+	// When several chains hold it, Owner is the first in directory order.
+	Owner *DirEntry
+	// Shared is set when more than one chain holds the block.
+	Shared bool
+}
+
+// Used reports whether a chain holds the block.
+func (u *BlockUse) Used() bool {
+	return u.System || u.Owner != nil
+}
+
+// Mismatch reports whether the BAM disagrees with the chains: either a block
+// in use is marked as free, or a block that nothing uses is allocated.
+func (u *BlockUse) Mismatch() bool {
+	return u.Free == u.Used() || u.Shared
+}
+
+// BlockMap reports the use of every block, indexed by track - 1 and sector.
+// A file holds the side sectors of a REL file and the info block and records
+// of a GEOS file as well as its chain. Broken chains are followed as far as
+// they go.
+func (d *Img) BlockMap() [][]BlockUse {
+	bam := d.BAM()
+	blocks := make([][]BlockUse, totalTrackCount)
+	for t := range blocks {
+		blocks[t] = make([]BlockUse, sectorCount(uint8(t + 1)))
+		for s := range blocks[t] {
+			ts := TS{uint8(t + 1), uint8(s)}
+			blocks[t][s] = BlockUse{TS: ts, Free: bam.Avail(ts)}
+		}
+	}
+	use := func(ts TS) *BlockUse {
+		return &blocks[ts.T - 1][ts.S]
+	}
+
+	use(TS{bamTrack, 0}).System = true
+	dir, _ := d.Chain(bam.DirTS)
+	for _, ts := range dir {
+		use(ts).System = true
+	}
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		blocks, _ := d.fileBlocks(ent)
+		for _, ts := range blocks {
+			u := use(ts)
+			if u.Used() {
+				u.Shared = true
+			}
+			if u.Owner == nil {
+				u.Owner = ent
+			}
+		}
+	}
+	return blocks
+}
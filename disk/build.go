@@ -0,0 +1,180 @@
+package disk
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// BuildSpec describes a disk to build from files on the host. It is usually
+// read from a JSON manifest kept next to the files.
+type BuildSpec struct {
+	Name string `json:"name"`
+	// ID is the two character disk ID. It defaults to "00" so every build of
+	// the same spec gives the same image.
+	ID string `json:"id"`
+	// Format is "d64", the default. The other CBM formats, "d71" and "d81",
+	// are not supported.
+	Format string `json:"format"`
+	// Output is where the image is written, relative to the manifest.
+	Output string `json:"output,omitempty"`
+	Files []BuildFile `json:"files"`
+}
+
+// BuildFile is an entry of the directory: a file copied from the host or a
+// separator.
+type BuildFile struct {
+	// Source is the path of the host file.
+	Source string `json:"source,omitempty"`
+	// Name defaults to the name of the source, converted by HostName.
+	Name string `json:"name,omitempty"`
+	// Type defaults to the type of the extension of the source, or PRG.
+	Type string `json:"type,omitempty"`
+	// Profile is an allocation profile as read by ParseProfile. It defaults
+	// to "rom".
+	Profile string `json:"profile,omitempty"`
+	// Interleave and Track override the interleave and start track of the
+	// profile when they are not zero.
+	Interleave int `json:"interleave,omitempty"`
+	Track int `json:"track,omitempty"`
+	Locked bool `json:"locked,omitempty"`
+	// Separator makes the entry a zero block DEL entry with this name, for
+	// dir art. SeparatorHex gives the name as raw PETSCII in hexadecimal.
+	Separator string `json:"separator,omitempty"`
+	SeparatorHex string `json:"separator_hex,omitempty"`
+}
+
+// ParseBuildSpec reads a JSON manifest. Unknown keys are an error, so typos do
+// not go unnoticed.
+func ParseBuildSpec(buf []byte) (*BuildSpec, error) {
+	spec := new(BuildSpec)
+	dec := json.NewDecoder(strings.NewReader(string(buf)))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(spec); err != nil {
+		return nil, fmt.Errorf("manifest: %w", err)
+	}
+	return spec, nil
+}
+
+// Build makes a new disk from a spec, reading the source files from fsys. The
+// image only depends on the spec and the files, so it is the same on every
+// run. The error names the entry of the spec which failed.
+func Build(spec *BuildSpec, fsys fs.FS) (*Img, error) {
+	switch strings.ToLower(spec.Format) {
+	case "", "d64":
+	case "d71", "d81":
+		return nil, fmt.Errorf("format %s is not supported, only d64", strings.ToUpper(spec.Format))
+	default:
+		return nil, fmt.Errorf("unknown format %q", spec.Format)
+	}
+	if len(spec.Name) > len(BAM{}.DiskName) {
+		return nil, fmt.Errorf("disk name %q is longer than 16 characters", spec.Name)
+	}
+	id := spec.ID
+	if id == "" {
+		id = "00"
+	}
+	if len(id) != 2 {
+		return nil, fmt.Errorf("disk ID %q must be 2 characters", spec.ID)
+	}
+	if len(spec.Files) > maxDirEntries {
+		return nil, fmt.Errorf("%d entries do not fit in the directory, which holds %d", len(spec.Files), maxDirEntries)
+	}
+
+	d := new(Img)
+	if err := d.Init(spec.Name, id); err != nil {
+		return nil, err
+	}
+	for i := range spec.Files {
+		if err := buildFile(d, fsys, &spec.Files[i]); err != nil {
+			label := spec.Files[i].Source
+			if label == "" {
+				label = spec.Files[i].Name
+			}
+			return nil, fmt.Errorf("files[%d] %q: %w", i, label, err)
+		}
+	}
+	return d, nil
+}
+
+func buildFile(d *Img, fsys fs.FS, f *BuildFile) error {
+	if f.Separator != "" || f.SeparatorHex != "" {
+		name := []byte(f.Separator)
+		if f.SeparatorHex != "" {
+			var err error
+			if name, err = hex.DecodeString(f.SeparatorHex); err != nil {
+				return fmt.Errorf("bad separator_hex: %w", err)
+			}
+		}
+		ent, err := Separator(name)
+		if err != nil {
+			return err
+		}
+		return d.InsertEntry(len(d.Directory()), ent)
+	}
+	if f.Source == "" {
+		return errors.New("needs a source or a separator")
+	}
+
+	data, err := fs.ReadFile(fsys, path.Clean(f.Source))
+	if err != nil {
+		return err
+	}
+	name, typ, data, err := hostFile(f.Source, data)
+	if err != nil {
+		return err
+	}
+	if f.Name != "" {
+		name = []byte(f.Name)
+	}
+	if len(name) > len(DirEntry{}.Filename) {
+		return fmt.Errorf("name %q is longer than 16 characters", name)
+	}
+	if f.Type != "" {
+		if typ, err = ParseFileType(f.Type); err != nil {
+			return err
+		}
+	}
+	if typ == REL {
+		return errors.New("REL files can not be built")
+	}
+
+	profile := ProfileROM
+	if f.Profile != "" {
+		if profile, err = ParseProfile(f.Profile); err != nil {
+			return err
+		}
+	}
+	if f.Interleave != 0 {
+		if f.Interleave < 1 || f.Interleave > 20 {
+			return fmt.Errorf("interleave %d is out of range 1-20", f.Interleave)
+		}
+		profile.Interleave = uint8(f.Interleave)
+	}
+	if f.Track != 0 {
+		if f.Track < 1 || f.Track > totalTrackCount || f.Track == bamTrack {
+			return fmt.Errorf("start track %d is not a track for files", f.Track)
+		}
+		profile.StartTrack = uint8(f.Track)
+	}
+
+	ent, err := d.WriteFile(string(name), typ, data, &WriteOptions{Strategy: profile})
+	switch {
+	case errors.Is(err, DiskFull):
+		need := (len(data) + len(RawBlock{}.Data) - 1) / len(RawBlock{}.Data)
+		if need == 0 {
+			need = 1
+		}
+		return fmt.Errorf("%w: needs %d blocks, %d free", err, need, d.BAM().BlocksFree())
+	case err != nil:
+		return err
+	}
+	if f.Locked {
+		ent.FileType |= FlagLocked
+	}
+	return nil
+}
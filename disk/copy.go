@@ -0,0 +1,181 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+)
+
+// CopyOptions changes how CopyFile stores a file on the destination disk.
+type CopyOptions struct {
+	// Name is the name of the copy. It defaults to the name of the file.
+	Name string
+	// KeepLayout puts every block on the track and sector it has on the
+	// source disk when that block is free on the destination. The other
+	// blocks come from the allocator.
+	KeepLayout bool
+	// Replace overwrites a file that already exists on the destination disk,
+	// unless it is locked.
+	Replace bool
+	// Strategy chooses the blocks of the copy. The default allocator is used
+	// when it is nil.
+	Strategy AllocStrategy
+}
+
+// CopyFile copies a file from disk src to disk dst, block by block, so that
+// its type and flags, the side sectors of a REL file and the info block and
+// records of a GEOS file are kept. The blocks are taken from the allocator of
+// dst, or kept in place with KeepLayout. The directory entry is copied as it
+// is apart from the links, so the block count shown in the directory does not
+// change either. The two disks can be the same if the copy gets another name.
+//
+// Nothing is changed on dst if the file does not fit.
+func CopyFile(dst, src *Img, name string, opts *CopyOptions) (*DirEntry, error) {
+	if opts == nil {
+		opts = &CopyOptions{}
+	}
+	sent := src.Lookup(name)
+	if sent == nil {
+		return nil, FileNotFound
+	}
+	ent := *sent
+	if !ent.FileType.Closed() {
+		return nil, errors.New("file was never closed")
+	}
+	newName := opts.Name
+	if newName == "" {
+		newName = UnpadBytes(ent.Filename[:])
+	}
+	if len(newName) > len(DirEntry{}.Filename) {
+		return nil, errors.New("name overflow")
+	}
+	old := dst.Lookup(newName)
+	switch {
+	case old == nil:
+	case old == sent:
+		return nil, errors.New("can not copy a file over itself")
+	case !opts.Replace:
+		return nil, FileExists
+	case old.FileType.Locked():
+		return nil, FileLocked
+	}
+	blocks, err := src.fileBlocks(&ent)
+	if err != nil {
+		return nil, err
+	}
+
+	moved, err := copyBlocks(dst, src, &ent, blocks, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	// a replaced file keeps its place in the directory
+	dent := old
+	if old != nil {
+		oldBlocks, _ := dst.fileBlocks(old)
+		dst.freeChain(oldBlocks)
+	} else if dent, err = dst.NewDirEntry(); err != nil {
+		dst.freeCopy(moved)
+		return nil, err
+	}
+	dent.relink(&ent, moved)
+	dent.SetFilename(newName)
+	return dent, nil
+}
+
+// copyBlocks copies the blocks of a file from src to dst and points their
+// links, the side sectors of a REL file and the index of a VLIR file to the
+// copies. It returns where each block went. Nothing is allocated on dst when
+// the file does not fit.
+func copyBlocks(dst, src *Img, ent *DirEntry, blocks []TS, opts *CopyOptions) (map[TS]TS, error) {
+	// choose the blocks of the copy
+	bam := dst.BAM()
+	moved := make(map[TS]TS, len(blocks))
+	if opts.KeepLayout {
+		for _, ts := range blocks {
+			if bam.Avail(ts) {
+				bam.Alloc(ts)
+				moved[ts] = ts
+			}
+		}
+	}
+	a := (&WriteOptions{Strategy: opts.Strategy}).allocator(bam)
+	for _, ts := range blocks {
+		if _, ok := moved[ts]; ok {
+			continue
+		}
+		nts, err := a.Alloc()
+		if err != nil {
+			dst.freeCopy(moved)
+			return nil, err
+		}
+		moved[ts] = nts
+	}
+
+	// copy the blocks, pointing their links and tables to the new blocks
+	move := func(buf []byte) error {
+		ts := TS{buf[0], buf[1]}
+		if ts.T == 0 {
+			return nil
+		}
+		nts, ok := moved[ts]
+		if !ok {
+			return fmt.Errorf("%d/%d is not a block of the file", ts.T, ts.S)
+		}
+		buf[0], buf[1] = nts.T, nts.S
+		return nil
+	}
+	side := make(map[TS]bool)
+	if ent.FileType.Base() == REL {
+		chain, _ := src.Chain(ent.RelSideSector)
+		for _, ts := range chain {
+			side[ts] = true
+		}
+	}
+	for _, ts := range blocks {
+		buf := blockBytes(dst, moved[ts])
+		*buf = *blockBytes(src, ts)
+		err := move(buf[0:2])
+		// side sectors list each other from byte 4, then the data blocks;
+		// the index of a VLIR file lists the chains of the records
+		var table int
+		switch {
+		case side[ts]:
+			table = 4
+		case ent.geosVLIR() && ts == ent.FileTS:
+			table = 2
+		}
+		for i := table; table > 0 && i < blockSize && err == nil; i += 2 {
+			err = move(buf[i:i + 2])
+		}
+		if err != nil {
+			dst.freeCopy(moved)
+			return nil, fmt.Errorf("block %d/%d: %w", ts.T, ts.S, err)
+		}
+	}
+	return moved, nil
+}
+
+// freeCopy frees the blocks taken by copyBlocks.
+func (d *Img) freeCopy(moved map[TS]TS) {
+	bam := d.BAM()
+	for _, ts := range moved {
+		bam.Free(ts)
+	}
+}
+
+// relink sets the entry to a copy of ent whose blocks were moved, keeping its
+// own directory link. A pending save-with-replace is dropped, but GEOS files
+// keep their date.
+func (fe *DirEntry) relink(ent *DirEntry, moved map[TS]TS) {
+	link := fe.DirLink
+	*fe = *ent
+	fe.DirLink = link
+	fe.FileType &^= FlagReplace
+	fe.FileTS = moved[ent.FileTS]
+	if ent.FileType.Base() == REL || ent.GEOS() {
+		fe.RelSideSector = moved[ent.RelSideSector]
+	}
+	if !ent.GEOS() {
+		fe.SaveReplace = TS{}
+	}
+}
@@ -0,0 +1,181 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"sort"
+)
+
+// FieldDiff is a field of the BAM that differs between two disks.
+type FieldDiff struct {
+	Field string `json:"field"`
+	Old string `json:"old"`
+	New string `json:"new"`
+}
+
+// FileDiff is a file that differs between two disks. Path is empty for an
+// added file and NewPath for a removed one. A renamed file has the same
+// contents under another path. A changed file has other contents or another
+// mode under the same path.
+type FileDiff struct {
+	Op string `json:"op"`
+	Path string `json:"path,omitempty"`
+	NewPath string `json:"new_path,omitempty"`
+	Size int64 `json:"size"`
+	NewSize int64 `json:"new_size"`
+	Mode string `json:"mode,omitempty"`
+	NewMode string `json:"new_mode,omitempty"`
+	Hash string `json:"hash,omitempty"`
+	NewHash string `json:"new_hash,omitempty"`
+}
+
+// Diff lists the differences between two disks.
+type Diff struct {
+	Header []FieldDiff `json:"header"`
+	Files []FileDiff `json:"files"`
+	// Sectors holds every block whose bytes differ, in order.
+	Sectors []TS `json:"sectors"`
+}
+
+// Empty reports whether the disks are the same byte for byte.
+func (df *Diff) Empty() bool {
+	return len(df.Header) == 0 && len(df.Files) == 0 && len(df.Sectors) == 0
+}
+
+// Compare finds the differences between disk a and disk b. Files are compared
+// through the flat layout of FS, by path and by the SHA-256 of their contents,
+// so a file whose name or type changed is found as renamed.
+func Compare(a, b *Img) (*Diff, error) {
+	df := &Diff{Header: compareBAM(a.BAM(), b.BAM())}
+
+	before, err := fsSums(a)
+	if err != nil {
+		return nil, err
+	}
+	after, err := fsSums(b)
+	if err != nil {
+		return nil, err
+	}
+	var removed, added []string
+	for p, o := range before {
+		n, ok := after[p]
+		switch {
+		case !ok:
+			removed = append(removed, p)
+		case o.hash != n.hash || o.mode != n.mode:
+			df.Files = append(df.Files, fileDiff("changed", p, p, o, n))
+		}
+	}
+	for p := range after {
+		if _, ok := before[p]; !ok {
+			added = append(added, p)
+		}
+	}
+	sort.Strings(removed)
+	sort.Strings(added)
+	paired := make(map[string]bool)
+	for _, p := range removed {
+		op, np := "removed", ""
+		for _, q := range added {
+			if !paired[q] && after[q].hash == before[p].hash {
+				op, np = "renamed", q
+				paired[q] = true
+				break
+			}
+		}
+		df.Files = append(df.Files, fileDiff(op, p, np, before[p], after[np]))
+	}
+	for _, q := range added {
+		if !paired[q] {
+			df.Files = append(df.Files, fileDiff("added", "", q, fileSum{}, after[q]))
+		}
+	}
+	sort.SliceStable(df.Files, func(i, j int) bool {
+		return df.Files[i].sortKey() < df.Files[j].sortKey()
+	})
+
+	for t := uint8(1); t <= totalTrackCount; t++ {
+		for s := uint8(0); s < sectorCount(t); s++ {
+			ts := TS{t, s}
+			if *(*[blockSize]byte)(a.Block(ts)) != *(*[blockSize]byte)(b.Block(ts)) {
+				df.Sectors = append(df.Sectors, ts)
+			}
+		}
+	}
+	return df, nil
+}
+
+func (fd *FileDiff) sortKey() string {
+	if fd.Path != "" {
+		return fd.Path
+	}
+	return fd.NewPath
+}
+
+// fileSum is what Compare knows of a file.
+type fileSum struct {
+	size int64
+	mode fs.FileMode
+	hash string
+}
+
+func fileDiff(op, p, np string, o, n fileSum) FileDiff {
+	fd := FileDiff{Op: op, Path: p, NewPath: np, Size: o.size, NewSize: n.size, Hash: o.hash, NewHash: n.hash}
+	if p != "" {
+		fd.Mode = o.mode.String()
+	}
+	if np != "" {
+		fd.NewMode = n.mode.String()
+	}
+	return fd
+}
+
+// fsSums reads every file of a disk through its file system.
+func fsSums(d *Img) (map[string]fileSum, error) {
+	fsys := d.FS(FlatRoot())
+	sums := make(map[string]fileSum)
+	err := fs.WalkDir(fsys, ".", func(p string, ent fs.DirEntry, err error) error {
+		if err != nil || ent.IsDir() {
+			return err
+		}
+		buf, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			return err
+		}
+		sum := sha256.Sum256(buf)
+		sums[p] = fileSum{int64(len(buf)), info.Mode(), hex.EncodeToString(sum[:])}
+		return nil
+	})
+	return sums, err
+}
+
+// compareBAM lists the header fields and the free maps of the tracks that
+// differ.
+func compareBAM(a, b *BAM) []FieldDiff {
+	var diffs []FieldDiff
+	field := func(name, old, new string) {
+		if old != new {
+			diffs = append(diffs, FieldDiff{name, old, new})
+		}
+	}
+	field("name", fmt.Sprintf("%q", UnpadBytes(a.DiskName[:])), fmt.Sprintf("%q", UnpadBytes(b.DiskName[:])))
+	field("id", fmt.Sprintf("%q", a.DiskID[:]), fmt.Sprintf("%q", b.DiskID[:]))
+	field("dos version", fmt.Sprintf("%q", a.DOSVersion[:]), fmt.Sprintf("%q", b.DOSVersion[:]))
+	field("format", fmt.Sprintf("%02x", a.DriveFormat), fmt.Sprintf("%02x", b.DriveFormat))
+	field("dir", fmt.Sprintf("%d/%d", a.DirTS.T, a.DirTS.S), fmt.Sprintf("%d/%d", b.DirTS.T, b.DirTS.S))
+	field("blocks free", fmt.Sprint(a.BlocksFree()), fmt.Sprint(b.BlocksFree()))
+	for i := range a.AvailMap {
+		ae, be := &a.AvailMap[i], &b.AvailMap[i]
+		field(fmt.Sprintf("track %d", i + 1),
+			fmt.Sprintf("%d % x", ae.Count, ae.free), fmt.Sprintf("%d % x", be.Count, be.free))
+	}
+	field("unused", hex.EncodeToString(append([]byte{a.Unused1}, a.Unused2[:]...)),
+		hex.EncodeToString(append([]byte{b.Unused1}, b.Unused2[:]...)))
+	return diffs
+}
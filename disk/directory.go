@@ -0,0 +1,153 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+)
+
+var (
+	DirFull = errors.New("no room left in directory track")
+	BadIndex = errors.New("directory index out of range")
+)
+
+// maxDirEntries is the number of entries that fit in the directory track.
+const maxDirEntries = 8 * (19 - 1)
+
+// SetRawName copies a name into the entry without converting it. Unused bytes
+// are padded with shifted spaces. Since the listing ends the name at the first
+// shifted space, the bytes after one are printed behind the closing quote,
+// which is how names like `"DEMO"  ,8,1` are made.
+func (fe *DirEntry) SetRawName(name []byte) error {
+	if len(name) > len(fe.Filename) {
+		return fmt.Errorf("name longer than %d bytes", len(fe.Filename))
+	}
+	n := copy(fe.Filename[:], name)
+	for i := n; i < len(fe.Filename); i++ {
+		fe.Filename[i] = padByte
+	}
+	return nil
+}
+
+// Separator returns a zero block DEL entry, which dir art and the separator
+// lines of a listing are made of.
+func Separator(name []byte) (DirEntry, error) {
+	ent := DirEntry{FileType: DEL}
+	err := ent.SetRawName(name)
+	return ent, err
+}
+
+// Directory returns a copy of every entry in the directory which is not
+// scratched, in directory order. Use SetDirectory to write them back.
+func (d *Img) Directory() []DirEntry {
+	var ents []DirEntry
+	for _, ent := range d.DirEntries() {
+		if !ent.IsScratched() {
+			ents = append(ents, *ent)
+		}
+	}
+	return ents
+}
+
+// SetDirectory replaces the directory with the given entries, in order. The
+// entries are packed into as few directory blocks as possible: blocks of the
+// current directory are reused, new ones are allocated on the directory track
+// and the ones left over are freed. Only the directory changes, so every file
+// must already be stored on the disk.
+func (d *Img) SetDirectory(ents []DirEntry) error {
+	if len(ents) > maxDirEntries {
+		return DirFull
+	}
+	bam := d.BAM()
+	blocks, err := d.Chain(bam.DirTS)
+	if err != nil {
+		return fmt.Errorf("directory: %w", err)
+	}
+	need := (len(ents) + 7) / 8
+	if need == 0 {
+		need = 1
+	}
+	var extra []TS
+	if len(blocks) > need {
+		blocks, extra = blocks[:need], blocks[need:]
+	}
+	if len(blocks) < need {
+		a := bam.newDirAllocator(blocks[len(blocks)-1])
+		var added []TS
+		for len(blocks) < need {
+			ts, err := a.Alloc()
+			if err != nil {
+				d.freeChain(added)
+				if errors.Is(err, DiskFull) {
+					return DirFull
+				}
+				return err
+			}
+			added = append(added, ts)
+			blocks = append(blocks, ts)
+		}
+	}
+	d.freeChain(extra)
+
+	for i, ts := range blocks {
+		dir := (*DirBlock)(d.Block(ts))
+		*dir = DirBlock{}
+		for j := range dir.Files {
+			if k := 8*i + j; k < len(ents) {
+				dir.Files[j] = ents[k]
+				dir.Files[j].DirLink = TS{}
+			}
+		}
+		if i+1 < len(blocks) {
+			dir.SetNext(blocks[i+1])
+		} else {
+			dir.Init()
+		}
+	}
+	return nil
+}
+
+// MoveEntry moves the entry at index from to index to. Indexes count the
+// entries returned by Directory.
+func (d *Img) MoveEntry(from, to int) error {
+	ents := d.Directory()
+	if from < 0 || from >= len(ents) || to < 0 || to >= len(ents) {
+		return BadIndex
+	}
+	ent := ents[from]
+	ents = append(ents[:from], ents[from+1:]...)
+	ents = append(ents[:to], append([]DirEntry{ent}, ents[to:]...)...)
+	return d.SetDirectory(ents)
+}
+
+// InsertEntry adds an entry to the directory at index pos, which may be the
+// number of entries to add it at the end. Indexes count the entries returned
+// by Directory.
+func (d *Img) InsertEntry(pos int, ent DirEntry) error {
+	ents := d.Directory()
+	if pos < 0 || pos > len(ents) {
+		return BadIndex
+	}
+	ents = append(ents[:pos], append([]DirEntry{ent}, ents[pos:]...)...)
+	return d.SetDirectory(ents)
+}
+
+// InsertSeparator adds a zero block DEL entry with a raw PETSCII name at index
+// pos.
+func (d *Img) InsertSeparator(pos int, name []byte) error {
+	ent, err := Separator(name)
+	if err != nil {
+		return err
+	}
+	return d.InsertEntry(pos, ent)
+}
+
+// SortDirectory orders the entries of the directory. The sort is stable, so
+// entries which compare equal keep their order.
+func (d *Img) SortDirectory(less func(a, b *DirEntry) bool) error {
+	ents := d.Directory()
+	sort.SliceStable(ents, func(i, j int) bool {
+		return less(&ents[i], &ents[j])
+	})
+	return d.SetDirectory(ents)
+}
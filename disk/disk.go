@@ -5,6 +5,8 @@ package disk
 
 import (
 	"errors"
+	"fmt"
+	"strings"
 	"unsafe"
 )
 
@@ -23,47 +25,110 @@ const (
 	SectorDirStagger = 3
 )
 
+// FileType is the file type byte of a directory entry. The low three bits
+// hold the base type and the high bits are flags.
+type FileType uint8
+
+// File type flags.
+const (
+	FlagReplace FileType = 0x20 // set while a save-with-replace is in progress
+	FlagLocked FileType = 0x40
+	FlagClosed FileType = 0x80 // cleared while the file is open for writing
+)
+
 // File type bytes (for reference).
 const (
-	Scratched = 0x00
-	DEL = 0x80
-	SEQ = 0x81
-	PRG = 0x82
-	USR = 0x83
-	REL = 0x84
-	UnclosedDEL = 0x00
-	UnclosedSEQ = 0x01
-	UnclosedPRG = 0x02
-	UnclosedUSR = 0x03
-	UnclosedREL = 0x04 // "cannot occur"
-	ReplaceDEL = 0xA0
-	ReplaceSEQ = 0xA1
-	ReplacePRG = 0xA2
-	ReplaceUSR = 0xA3
-	ReplaceREL = 0xA4
-	LockDEL = 0xC2
-	LockSEQ = 0xC3
-	LockPRG = 0xC4
-	LockUSR = 0xC5
-	LockREL = 0xC6
+	Scratched FileType = 0x00
+	DEL FileType = 0x80
+	SEQ FileType = 0x81
+	PRG FileType = 0x82
+	USR FileType = 0x83
+	REL FileType = 0x84
+	UnclosedDEL FileType = 0x00
+	UnclosedSEQ FileType = 0x01
+	UnclosedPRG FileType = 0x02
+	UnclosedUSR FileType = 0x03
+	UnclosedREL FileType = 0x04 // "cannot occur"
+	ReplaceDEL FileType = 0xA0
+	ReplaceSEQ FileType = 0xA1
+	ReplacePRG FileType = 0xA2
+	ReplaceUSR FileType = 0xA3
+	ReplaceREL FileType = 0xA4
+	LockDEL FileType = 0xC0
+	LockSEQ FileType = 0xC1
+	LockPRG FileType = 0xC2
+	LockUSR FileType = 0xC3
+	LockREL FileType = 0xC4
 )
 
+var fileTypeNames = [...]string{"DEL", "SEQ", "PRG", "USR", "REL"}
+
+// Base strips the flags from the file type and returns it as the closed type,
+// so it can be compared against DEL, SEQ, PRG, USR and REL.
+func (ft FileType) Base() FileType {
+	return ft & 0x07 | FlagClosed
+}
+
+func (ft FileType) Locked() bool {
+	return ft & FlagLocked != 0
+}
+
+func (ft FileType) Closed() bool {
+	return ft & FlagClosed != 0
+}
+
+func (ft FileType) Replace() bool {
+	return ft & FlagReplace != 0
+}
+
+// Set returns the file type with the given flags set or cleared.
+func (ft FileType) Set(flags FileType, on bool) FileType {
+	if on {
+		return ft | flags
+	}
+	return ft &^ flags
+}
+
+// String returns the three letter name of the base type, as the DOS prints it
+// in directory listings.
+func (ft FileType) String() string {
+	if i := int(ft & 0x07); i < len(fileTypeNames) {
+		return fileTypeNames[i]
+	}
+	return "???"
+}
+
+// ParseFileType converts a three letter type name, in any case, to the closed
+// file type.
+func ParseFileType(name string) (FileType, error) {
+	for i, s := range fileTypeNames {
+		if strings.EqualFold(name, s) {
+			return DEL + FileType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown file type: %s", name)
+}
+
 var (
 	BadTS = errors.New("invalid track/sector")
+	ChainLoop = errors.New("block chain loops back on itself")
 )
 
 type geom struct {
 	trackMin, trackMax, sectorCount uint8
 	sectorOffset uint16
+	// The speed zone sets the bit rate, which gives the outer tracks room for
+	// more bytes.
+	speedZone uint8
 }
 
 type geometryTable [4]geom
 
 var geometry = geometryTable{
-	{1, 17, 21, 0},
-	{18, 24, 19, 357},
-	{25, 30, 18, 490},
-	{31, 40, 17, 598},
+	{1, 17, 21, 0, 3},
+	{18, 24, 19, 357, 2},
+	{25, 30, 18, 490, 1},
+	{31, 40, 17, 598, 0},
 	// the average disk has 35 tracks and 683 sectors/blocks
 	// special disks later added tracks for 40 total
 }
@@ -85,6 +150,15 @@ func sectorCount(track uint8) uint8 {
 	return g.sectorCount
 }
 
+// SectorCount returns the number of sectors on a track, or 0 if the disk has no
+// such track.
+func SectorCount(track uint8) uint8 {
+	if track == 0 || track > totalTrackCount {
+		return 0
+	}
+	return sectorCount(track)
+}
+
 func trackCapacity(track uint8) uint16 {
 	return blockSize * uint16(sectorCount(track))
 }
@@ -113,6 +187,9 @@ func (ts TS) Offset() (uint32, error) {
 }
 
 func (ts TS) IsValid() bool {
+	if ts.T > totalTrackCount {
+		return false
+	}
 	g, err := geometry.Lookup(ts.T)
 	if err != nil {
 		return false
@@ -164,7 +241,7 @@ type DirEntry struct {
 	// Only the DirLink in the first file entry of the directory block is set to a value
 	// The others are zeroed.
 	DirLink TS;
-	FileType uint8;
+	FileType FileType;
 	FileTS TS;
 	Filename [16]byte;
 	// only for REL files
@@ -190,6 +267,14 @@ func (fe *DirEntry) SetFilename(filename string) {
 	copy(fe.Filename[:], PadString(filename, 16))
 }
 
+// GEOS reports whether the entry is of a GEOS file. GEOS uses the REL fields
+// of the entry for the track and sector of the info block and for the
+// structure of the file, and keeps its file type and date in the bytes after
+// them.
+func (fe *DirEntry) GEOS() bool {
+	return fe.FileType.Base() != REL && fe.Unused[0] != 0 && !fe.RelSideSector.IsNull()
+}
+
 func (fe *DirEntry) BlockCount() uint16 {
 	return uint16(fe.BlockSizeLo) | uint16(fe.BlockSizeHi) << 8
 }
@@ -212,12 +297,10 @@ func (fe *DirEntry) SetByteLen(size int) {
 
 func (fe *DirEntry) FileBlock(d *Img) FileBlock {
 	raw := d.Block(fe.FileTS)
-	switch fe.FileType {
-	case DEL, SEQ: return (*RawBlock)(raw)
-	case PRG: return (*PrgBlock)(raw)
-	case USR, REL: panic("unimplemented")
-	default: panic("unknown file type")
+	if fe.FileType.Base() == PRG {
+		return (*PrgBlock)(raw)
 	}
+	return (*RawBlock)(raw)
 }
 
 // PRG files have a PrgBlock, followed by RawBlocks.
@@ -233,8 +316,10 @@ func (fb *RawBlock) EOF() bool {
 	return fb.Link.T == 0
 }
 
+// EndFile marks this as the last block of the file holding size bytes of data.
+// Like the DOS, the sector of the link is set to the index of the last byte.
 func (fb *RawBlock) EndFile(size uint8) {
-	fb.Link = TS{0, size}
+	fb.Link = TS{0, size + 1}
 }
 
 // Truncate sets this RawBlock as the last block in the file and stores the data at the same time.
@@ -242,7 +327,7 @@ func (fb *RawBlock) Truncate(end []byte) error {
 	if len(end) > 254 {
 		return errors.New("overflow")
 	}
-	fb.Link = TS{0, uint8(len(end))}
+	fb.EndFile(uint8(len(end)))
 	copy(fb.Data[:], end)
 	return nil
 }
@@ -257,7 +342,10 @@ func (fb *RawBlock) NextBlock(d *Img) FileBlock {
 
 func (fb *RawBlock) Len() uint8 {
 	if fb.EOF() {
-		return fb.Link.S
+		if fb.Link.S == 0 {
+			return 0
+		}
+		return fb.Link.S - 1
 	}
 	return 254
 }
@@ -297,7 +385,7 @@ func (prg *PrgBlock) NextBlock(d *Img) FileBlock {
 
 // Len includes the load address in the length.
 func (prg *PrgBlock) Len() uint8 {
-	return 254
+	return (*RawBlock)(unsafe.Pointer(prg)).Len()
 }
 
 // Bytes returns the two-byte load address before the beginning of the PRG data. This is often
@@ -349,10 +437,7 @@ func (d *Img) NewDirEntry() (*DirEntry, error) {
 	bam := d.BAM()
 	ts := bam.DirTS
 	dir := (*DirBlock)(d.Block(ts))
-	a := bam.NewAllocator()
-	a.TS = bam.DirTS
-	a.SectorStagger = SectorDirStagger
-	a.NextTrack = func (_ uint8) uint8 { return 0 }
+	a := bam.newDirAllocator(bam.DirTS)
 
 	// find the next available dir entry
 	var file *DirEntry
@@ -371,13 +456,56 @@ func (d *Img) NewDirEntry() (*DirEntry, error) {
 		case nil:
 			// do nothing
 		case DiskFull:
-			return nil, errors.New("no room left in directory track")
+			return nil, DirFull
 		default:
 			return nil, err
 		}
 		dir.SetNext(ts)
 		dir = (*DirBlock)(d.Block(ts))
+		// the block may hold old data, or zeros which would link to 0/0
+		*dir = DirBlock{}
+		dir.Init()
 	}
 	return file, nil
 }
 
+
+// DirEntries returns a pointer to every slot in the directory chain, including
+// empty and scratched slots, in directory order.
+func (d *Img) DirEntries() []*DirEntry {
+	var entries []*DirEntry
+	dir := d.Dir()
+	seen := map[*DirBlock]bool{}
+	for !seen[dir] {
+		seen[dir] = true
+		for i := range dir.Files {
+			entries = append(entries, &dir.Files[i])
+		}
+		ts, ok := dir.Next()
+		if !ok || !ts.IsValid() {
+			break
+		}
+		dir = (*DirBlock)(d.Block(ts))
+	}
+	return entries
+}
+
+// Chain follows the block links starting at ts and returns every block in the
+// chain, in order. Returns BadTS if a link points outside of the disk and
+// ChainLoop if a block is visited twice.
+func (d *Img) Chain(ts TS) ([]TS, error) {
+	var chain []TS
+	seen := make(map[TS]bool)
+	for ts.T != 0 {
+		if !ts.IsValid() {
+			return chain, BadTS
+		}
+		if seen[ts] {
+			return chain, ChainLoop
+		}
+		seen[ts] = true
+		chain = append(chain, ts)
+		ts = (*RawBlock)(d.Block(ts)).Link
+	}
+	return chain, nil
+}
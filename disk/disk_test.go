@@ -2,11 +2,21 @@ package disk
 
 import (
 	"bytes"
+	"encoding/binary"
 	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"io/fs"
+	"net/http"
 	"os"
+	"path"
+	"reflect"
+	"strings"
 	"testing"
+	"testing/fstest"
+	"testing/iotest"
+	"text/template"
 )
 
 func TestDiskBlock(t *testing.T) {
@@ -120,3 +130,1287 @@ func TestExtractDiskFS(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func loadTestImage(t *testing.T) *Img {
+	t.Helper()
+	b, err := os.ReadFile("testdata/dc10c.d64")
+	if err != nil {
+		t.Fatal(err)
+	}
+	img := new(Img)
+	copy(img[:], b)
+	return img
+}
+
+func TestReadROMFile(t *testing.T) {
+	// The 1541 sets the sector of the link in the last block of a file to the
+	// index of the last byte used, so a full block ends with 00 FF and a
+	// block holding a single byte ends with 00 02.
+	img := loadTestImage(t)
+	buf, err := img.ReadFile(img.Lookup("DC64"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(buf) != 11246 || buf[len(buf) - 1] != 0xE0 {
+		t.Errorf("read %d bytes ending in %02x", len(buf), buf[len(buf) - 1])
+	}
+
+	var d Img
+	d.Init("TEST", "01")
+	for _, tc := range []struct {
+		name string
+		size int
+		link TS
+	}{
+		{"FULL", 254, TS{0, 0xFF}},
+		{"ONE", 1, TS{0, 2}},
+		{"TWO BLOCKS", 255, TS{0, 2}},
+	} {
+		data := bytes.Repeat([]byte{0x55}, tc.size)
+		ent, err := d.WriteFile(tc.name, SEQ, data, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		chain, _ := d.Chain(ent.FileTS)
+		if link := (*RawBlock)(d.Block(chain[len(chain) - 1])).Link; link != tc.link {
+			t.Errorf("%d bytes: last block links to %v", tc.size, link)
+		}
+		if buf, _ := d.ReadFile(ent); !bytes.Equal(buf, data) {
+			t.Errorf("%d bytes: read back %d bytes", tc.size, len(buf))
+		}
+	}
+}
+
+func TestUndelete(t *testing.T) {
+	img := loadTestImage(t)
+	orig := *img
+	bam := img.BAM()
+	ent := img.DirEntries()[2]
+	chain, err := img.Chain(ent.FileTS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chain) != int(ent.BlockCount()) {
+		t.Fatal("chain length does not match block count:", len(chain))
+	}
+
+	// scratch the file the same way the DOS does
+	ent.FileType = Scratched
+	for _, ts := range chain {
+		bam.Free(ts)
+	}
+	list := img.Recoverable()
+	if len(list) != 1 || list[0].Entry != ent || list[0].Type != PRG {
+		t.Fatalf("expected one recoverable PRG: %+v", list)
+	}
+	if len(img.Orphans()) != 0 {
+		t.Error("scratched entries should not be listed as orphans")
+	}
+	if err = img.Undelete(ent, 0); err != nil {
+		t.Fatal(err)
+	}
+	if *img != orig {
+		t.Error("undeleted image differs from the original")
+	}
+
+	// forget the directory entry completely
+	name := ent.FilenameString()
+	ent.FileType = Scratched
+	ent.FileTS = TS{}
+	for _, ts := range chain {
+		bam.Free(ts)
+	}
+	orphans := img.Orphans()
+	if len(orphans) != 1 || orphans[0][0] != chain[0] {
+		t.Fatalf("expected one orphan at %v: %v", chain[0], orphans)
+	}
+	if _, err = img.Adopt(orphans[0][0], name, PRG); err != nil {
+		t.Fatal(err)
+	}
+	if *img != orig {
+		t.Error("adopted image differs from the original")
+	}
+	if _, err = img.Adopt(chain[0], name, PRG); err != ChainClash {
+		t.Error("expected ChainClash when adopting an allocated chain:", err)
+	}
+}
+
+func TestFileType(t *testing.T) {
+	for _, tc := range []struct {
+		ft FileType
+		base FileType
+		locked, closed, replace bool
+	}{
+		{PRG, PRG, false, true, false},
+		{LockPRG, PRG, true, true, false},
+		{LockDEL, DEL, true, true, false},
+		{UnclosedSEQ, SEQ, false, false, false},
+		{ReplaceUSR, USR, false, true, true},
+	} {
+		if tc.ft.Base() != tc.base || tc.ft.Locked() != tc.locked ||
+			tc.ft.Closed() != tc.closed || tc.ft.Replace() != tc.replace {
+			t.Errorf("%#02x: wrong flags", uint8(tc.ft))
+		}
+	}
+	if PRG.Set(FlagLocked, true) != LockPRG || LockPRG.Set(FlagLocked, false) != PRG {
+		t.Error("failed to toggle the lock flag")
+	}
+	if ft, err := ParseFileType("seq"); err != nil || ft != SEQ {
+		t.Error("failed to parse file type:", ft, err)
+	}
+}
+
+func TestWriteFile(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	data := make([]byte, 600)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	ent, err := d.WriteFile("FILE", PRG, data, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.BlockCount() != 3 {
+		t.Error("expected 3 blocks:", ent.BlockCount())
+	}
+	buf, err := d.ReadFile(ent)
+	if err != nil || !bytes.Equal(buf, data) {
+		t.Fatal("read back different data:", err)
+	}
+	if _, err = d.WriteFile("FILE", PRG, data, nil); err != FileExists {
+		t.Error("expected FileExists:", err)
+	}
+
+	d.SetLocked("FILE", true)
+	if _, err = d.WriteFile("FILE", PRG, data, nil); err != FileLocked {
+		t.Error("expected FileLocked:", err)
+	}
+	if err = d.Remove("FILE", false); err != FileLocked {
+		t.Error("expected FileLocked:", err)
+	}
+	if err = d.Remove("FILE", true); err != nil {
+		t.Fatal(err)
+	}
+	var fresh Img
+	fresh.Init("TEST", "01")
+	if *d.BAM() != *fresh.BAM() {
+		t.Error("blocks were not freed")
+	}
+}
+
+func TestReplaceFile(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	bam := d.BAM()
+	free := bam.AvailMap
+	d.WriteFile("FILE", SEQ, make([]byte, 600), nil)
+	used := bam.AvailMap
+
+	data := bytes.Repeat([]byte("NEW"), 200)
+	opts := &WriteOptions{Replace: true}
+	ent, err := d.WriteFile("FILE", PRG, data, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ent.FileType != PRG || ent.SaveReplace != (TS{}) || ent.BlockCount() != 3 {
+		t.Errorf("replaced entry is wrong: %+v", ent)
+	}
+	if buf, _ := d.ReadFile(ent); !bytes.Equal(buf, data) {
+		t.Error("replaced file has the wrong contents")
+	}
+	if bam.AvailMap == used || bam.AvailMap == free {
+		t.Error("expected a different set of blocks in use")
+	}
+	d.Remove("FILE", false)
+	if bam.AvailMap != free {
+		t.Error("blocks were lost")
+	}
+
+	// The buggy replace leaves the new blocks marked as free, so the next file
+	// overwrites them.
+	d.WriteFile("FILE", SEQ, make([]byte, 600), nil)
+	opts.ReplaceBug = true
+	ent, _ = d.WriteFile("FILE", SEQ, data, opts)
+	if bam.AvailMap != free {
+		t.Error("expected the BAM to be left with every block free")
+	}
+	d.WriteFile("OTHER", SEQ, make([]byte, 2000), nil)
+	if buf, _ := d.ReadFile(ent); bytes.Equal(buf, data) {
+		t.Error("expected the replaced file to be corrupted")
+	}
+}
+
+// watchStrategy calls watch each time the allocator picks a block after the
+// first.
+type watchStrategy struct {
+	Profile
+	watch func()
+}
+
+func (w watchStrategy) Next(bam *BAM, prev TS) TS {
+	w.watch()
+	return w.Profile.Next(bam, prev)
+}
+
+func TestReplaceInProgress(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	d.WriteFile("FILE", SEQ, make([]byte, 600), nil)
+	ent := d.Lookup("FILE")
+	old := ent.FileTS
+
+	var seen []TS
+	w := watchStrategy{ProfileROM, func() {
+		if ent.FileType & FlagReplace == 0 || ent.FileTS != old {
+			t.Errorf("entry not marked as being replaced: %+v", ent)
+		}
+		seen = append(seen, ent.SaveReplace)
+	}}
+	if _, err := d.WriteFile("FILE", SEQ, make([]byte, 600), &WriteOptions{Replace: true, Strategy: w}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) == 0 || seen[0].IsNull() || seen[0] != ent.FileTS {
+		t.Errorf("SaveReplace was %v while writing, the new chain starts at %v", seen, ent.FileTS)
+	}
+	if ent.FileType & FlagReplace != 0 || !ent.SaveReplace.IsNull() {
+		t.Errorf("replace state left in the entry: %+v", ent)
+	}
+
+	// a failed replace clears both again
+	if _, err := d.WriteFile("FILE", SEQ, make([]byte, 700*254), &WriteOptions{Replace: true}); !errors.Is(err, DiskFull) {
+		t.Fatalf("expected disk full, got %v", err)
+	}
+	if ent.FileType != SEQ || !ent.SaveReplace.IsNull() {
+		t.Errorf("failed replace left %+v", ent)
+	}
+}
+
+func TestOptimize(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	opts := &WriteOptions{Strategy: ProfileFill}
+	want := make(map[string][]byte)
+	var names []string
+	for i := 0; i < 30; i++ {
+		name := fmt.Sprintf("FILE%d", i)
+		data := bytes.Repeat([]byte{byte(i)}, 300*i+1)
+		if _, err := d.WriteFile(name, SEQ, data, opts); err != nil {
+			t.Fatal(err)
+		}
+		if i%3 == 0 {
+			d.Remove(name, false)
+			continue
+		}
+		want[name] = data
+		names = append(names, name)
+	}
+	d.SetLocked("FILE1", true)
+
+	if err := d.Optimize(ProfileContiguous); err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		name := ent.FilenameString()
+		got = append(got, name)
+		if buf, _ := d.ReadFile(ent); !bytes.Equal(buf, want[name]) {
+			t.Errorf("%s: contents changed", name)
+		}
+	}
+	if !reflect.DeepEqual(got, names) {
+		t.Errorf("directory order changed: %v", got)
+	}
+	if !d.Lookup("FILE1").FileType.Locked() {
+		t.Error("lost the lock flag")
+	}
+	if n := len(d.DirEntries()); n != 8*((len(names)+7)/8) {
+		t.Errorf("expected the directory to be compacted, got %d slots", n)
+	}
+	for _, il := range d.Interleaves() {
+		for gap := range il.Gaps {
+			if gap != 1 {
+				t.Errorf("%s: expected contiguous blocks, got a gap of %d", il.Name, gap)
+			}
+		}
+	}
+
+	// the rebuilt BAM matches the one validate would build
+	bam := *d.BAM()
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if bam != *d.BAM() {
+		t.Error("BAM differs after validate")
+	}
+}
+
+func TestOptimizeREL(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	opts := &WriteOptions{Strategy: ProfileFill}
+	d.WriteFile("GAP", SEQ, make([]byte, 3000), opts)
+	records := bytes.Repeat([]byte("R"), 600)
+	writeREL(t, &d, "RECORDS", records, 20)
+
+	// a GEOS VLIR file with an info block and one record
+	a := d.BAM().NewAllocator()
+	info, _ := a.Alloc()
+	index, _ := a.Alloc()
+	rec, _ := d.writeChain(a, []byte("VLIR RECORD"))
+	copy(blockBytes(&d, info)[2:], "INFO")
+	idx := blockBytes(&d, index)
+	idx[0], idx[1] = 0, 0xFF
+	idx[2], idx[3], idx[4], idx[5] = rec[0].T, rec[0].S, 0, 0xFF
+	ent, _ := d.NewDirEntry()
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: USR | FlagClosed, FileTS: index, RelSideSector: info, RelRecordSize: 1,
+		Unused: [4]byte{6, 86, 1, 2}, SaveReplace: TS{12, 30}}
+	ent.SetFilename("DESKTOP APP")
+	ent.SetBlockCount(3)
+	d.Remove("GAP", false)
+
+	if err := d.Optimize(ProfileContiguous); err != nil {
+		t.Fatal(err)
+	}
+	rel := d.Lookup("RECORDS")
+	chain, _ := d.Chain(rel.FileTS)
+	side := blockBytes(&d, rel.RelSideSector)
+	if len(chain) != 3 || (TS{side[4], side[5]}) != rel.RelSideSector || (TS{side[16], side[17]}) != chain[0] ||
+		(TS{side[20], side[21]}) != chain[2] {
+		t.Errorf("side sector of RECORDS does not point to the new blocks: % x", side[:22])
+	}
+	if buf, _ := d.ReadFile(rel); !bytes.Equal(buf, records) {
+		t.Error("RECORDS contents changed")
+	}
+	geos := d.Lookup("DESKTOP APP")
+	if !geos.GEOS() || geos.SaveReplace != (TS{12, 30}) || !bytes.HasPrefix(blockBytes(&d, geos.RelSideSector)[2:], []byte("INFO")) {
+		t.Errorf("GEOS info block or date lost: %+v", geos)
+	}
+	idx = blockBytes(&d, geos.FileTS)
+	if buf, _ := d.ReadFile(&DirEntry{FileTS: TS{idx[2], idx[3]}}); string(buf) != "VLIR RECORD" {
+		t.Errorf("VLIR record moved as %q", buf)
+	}
+
+	bam := *d.BAM()
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if bam != *d.BAM() {
+		t.Error("BAM differs after validate")
+	}
+}
+
+func TestOptimizeReserved(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	d.WriteFile("FILE", SEQ, make([]byte, 1000), nil)
+	d.BAM().Alloc(TS{1, 0})
+	before := d
+	if err := d.Optimize(ProfileContiguous); err == nil {
+		t.Error("expected an error for a block no file holds")
+	}
+	if d != before {
+		t.Error("disk changed")
+	}
+}
+
+func TestEditDirectory(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	for _, name := range []string{"C", "A", "B"} {
+		d.WriteFile(name, PRG, []byte{1, 8, 0}, nil)
+	}
+	names := func() string {
+		var s []string
+		for _, ent := range d.Directory() {
+			s = append(s, UnpadBytes(ent.Filename[:]))
+		}
+		return strings.Join(s, " ")
+	}
+
+	d.SortDirectory(func(a, b *DirEntry) bool {
+		return bytes.Compare(a.Filename[:], b.Filename[:]) < 0
+	})
+	if s := names(); s != "A B C" {
+		t.Errorf("sorted directory is %q", s)
+	}
+	d.MoveEntry(2, 0)
+	if s := names(); s != "C A B" {
+		t.Errorf("moved directory is %q", s)
+	}
+	if err := d.MoveEntry(3, 0); err != BadIndex {
+		t.Errorf("expected BadIndex, got %v", err)
+	}
+
+	// fill a few directory blocks with separators then remove them again
+	free := *d.BAM()
+	for i := 0; i < 20; i++ {
+		if err := d.InsertSeparator(1, []byte("----\xa0,8,1")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := len(d.DirEntries()); n != 24 {
+		t.Errorf("expected 3 directory blocks, got %d slots", n)
+	}
+	sep := d.Directory()[1]
+	if sep.FileType != DEL || sep.BlockCount() != 0 || MatchName([]byte("----"), sep.Filename) == false {
+		t.Errorf("bad separator: %+v", sep)
+	}
+	if _, err := fs.ReadDir(d.FS(), "TEST"); err != nil {
+		t.Error(err)
+	}
+	ents := d.Directory()
+	if err := d.SetDirectory(append(ents[:1], ents[21:]...)); err != nil {
+		t.Fatal(err)
+	}
+	if *d.BAM() != free || len(d.DirEntries()) != 8 {
+		t.Error("expected the extra directory blocks to be freed")
+	}
+	for i := 0; i < maxDirEntries; i++ {
+		d.InsertSeparator(0, nil)
+	}
+	if err := d.InsertSeparator(0, nil); err != DirFull {
+		t.Errorf("expected DirFull, got %v", err)
+	}
+}
+
+func TestListing(t *testing.T) {
+	var d Img
+	d.Init("TEST DISK", "AB")
+	d.WriteFile("GAME", PRG, make([]byte, 600), nil)
+	d.SetLocked("GAME", true)
+	ent, _ := d.WriteFile("NOTE", SEQ, nil, nil)
+	ent.FileType = UnclosedSEQ
+	d.InsertSeparator(2, []byte("--\xa0,8,1"))
+
+	want := []byte{0x01, 0x04}
+	line := func(blocks uint16, text string) {
+		want = append(want, 0x01, 0x01, byte(blocks), byte(blocks >> 8))
+		want = append(want, text...)
+		want = append(want, 0)
+	}
+	line(0, "\x12\"TEST DISK       \" AB 2A")
+	line(3, "   \"GAME\"             PRG< ")
+	line(1, "   \"NOTE\"            *SEQ  ")
+	line(0, "   \"--\",8,1           DEL  ")
+	line(660, "BLOCKS FREE.             ")
+	want = append(want, 0, 0)
+	if got := d.Listing(); !bytes.Equal(got, want) {
+		t.Errorf("listing is\n%q\nwant\n%q", got, want)
+	}
+
+	text := string(d.ListingText())
+	if !strings.HasPrefix(text, "0 \x12\"TEST DISK") || !strings.Contains(text, "\r3    \"GAME\"") {
+		t.Errorf("bad listing text: %q", text)
+	}
+}
+
+func TestFS(t *testing.T) {
+	d := loadTestImage(t)
+	if err := fstest.TestFS(d.FS(), "DracCopy 1.0/DC64.PRG", "DracCopy 1.0/DB128.PRG"); err != nil {
+		t.Error(err)
+	}
+
+	var img Img
+	img.Init("A/B", "01")
+	img.WriteFile("GAME", PRG, []byte{1, 8, 2}, nil)
+	img.WriteFile("NOTE", SEQ, []byte("HELLO"), nil)
+	ent, _ := img.WriteFile("X", SEQ, []byte("ONE"), nil)
+	ent.SetRawName([]byte("GAME"))
+	img.WriteFile("..", USR, nil, nil)
+	img.WriteFile("\xc1/\xa0", USR, nil, nil)
+	img.InsertSeparator(0, []byte("----"))
+
+	tests := []struct {
+		opts []FSOption
+		files []string
+	}{
+		{nil, []string{"A%2FB/...USR", "A%2FB/GAME.PRG", "A%2FB/GAME.SEQ", "A%2FB/NOTE.SEQ", "A%2FB/%C1%2F.USR"}},
+		{[]FSOption{FlatRoot(), Extensions(ExtNone)}, []string{"%2E%2E", "GAME", "GAME~2", "NOTE", "%C1%2F"}},
+		{[]FSOption{FlatRoot(), Extensions(ExtNone), Names(NameReplace), Duplicates(DupFirst)}, []string{"__", "GAME", "NOTE"}},
+		{[]FSOption{FlatRoot(), Extensions(ExtP00), Names(NameSkip)}, []string{"GAME.P00", "GAME.S00", "NOTE.S00"}},
+	}
+	for i, test := range tests {
+		fsys := img.FS(test.opts...)
+		if err := fstest.TestFS(fsys, test.files...); err != nil {
+			t.Errorf("%d: %v", i, err)
+		}
+	}
+
+	buf, err := fs.ReadFile(img.FS(FlatRoot(), Extensions(ExtP00)), "NOTE.S00")
+	want := append([]byte("C64File\x00NOTE"), make([]byte, 14)...)
+	if err != nil || !bytes.Equal(buf, append(want, "HELLO"...)) {
+		t.Errorf("bad P00 file: %q, %v", buf, err)
+	}
+	names, _ := fs.Glob(img.FS(FlatRoot(), CBMGlob()), "G*,S")
+	if len(names) != 1 || names[0] != "GAME.SEQ" {
+		t.Errorf("CBM glob matched %v", names)
+	}
+}
+
+func TestFileHandles(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	d.WriteFile("FILE", SEQ, data, nil)
+	fsys := d.FS(FlatRoot())
+
+	f1, _ := fsys.Open("FILE.SEQ")
+	f2, _ := fsys.Open("FILE.SEQ")
+	buf1, buf2 := make([]byte, 300), make([]byte, 300)
+	f1.Read(buf1)
+	f2.Read(buf2)
+	if !bytes.Equal(buf1, data[:300]) || !bytes.Equal(buf2, data[:300]) {
+		t.Error("handles share their position")
+	}
+
+	rs := f1.(io.ReadSeeker)
+	if pos, err := rs.Seek(-10, io.SeekEnd); err != nil || pos != 990 {
+		t.Errorf("seek from end gave %d, %v", pos, err)
+	}
+	rest, _ := io.ReadAll(rs)
+	if !bytes.Equal(rest, data[990:]) {
+		t.Errorf("read %v after seeking", rest)
+	}
+	if _, err := rs.Seek(-1, io.SeekStart); err == nil {
+		t.Error("expected an error seeking before the start")
+	}
+
+	ra := f2.(io.ReaderAt)
+	buf := make([]byte, 100)
+	if n, err := ra.ReadAt(buf, 250); n != 100 || err != nil || !bytes.Equal(buf, data[250:350]) {
+		t.Errorf("ReadAt across blocks gave %d, %v", n, err)
+	}
+	if n, err := ra.ReadAt(buf, 950); n != 50 || err != io.EOF {
+		t.Errorf("ReadAt at the end gave %d, %v", n, err)
+	}
+	if info, _ := f2.Stat(); info.Size() != int64(len(data)) {
+		t.Errorf("size is %d", info.Size())
+	}
+	f3, _ := fsys.Open("FILE.SEQ")
+	if err := iotest.TestReader(f3, data); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFSInterfaces(t *testing.T) {
+	var d Img
+	d.Init("TEST", "01")
+	d.WriteFile("HELLO", SEQ, []byte("HELLO {{.}}"), nil)
+	fsys := d.FS()
+	_, ok1 := fsys.(fs.ReadFileFS)
+	_, ok2 := fsys.(fs.StatFS)
+	_, ok3 := fsys.(fs.SubFS)
+	_, ok4 := fsys.(fs.GlobFS)
+	_, ok5 := fsys.(fs.ReadDirFS)
+	if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 {
+		t.Error("missing an fs interface")
+	}
+
+	sub, err := fs.Sub(fsys, "TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := fstest.TestFS(sub, "HELLO.SEQ"); err != nil {
+		t.Error(err)
+	}
+	if _, err := fs.Sub(fsys, "TEST/HELLO.SEQ"); !errors.Is(err, fs.ErrInvalid) {
+		t.Errorf("expected ErrInvalid from Sub of a file, got %v", err)
+	}
+	if _, err := fs.Stat(fsys, "NOPE"); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+	var pe *fs.PathError
+	if _, err := fs.ReadFile(fsys, "TEST"); !errors.As(err, &pe) || pe.Op != "readfile" {
+		t.Errorf("expected a PathError reading a directory, got %v", err)
+	}
+
+	tmpl, err := template.ParseFS(sub, "*.SEQ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	tmpl.Execute(&out, "WORLD")
+	if out.String() != "HELLO WORLD" {
+		t.Errorf("template gave %q", out.String())
+	}
+
+	hf, err := http.FS(fsys).Open("/TEST")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos, err := hf.Readdir(-1); err != nil || len(infos) != 1 {
+		t.Errorf("http.FS listed %d files, %v", len(infos), err)
+	}
+}
+
+// copyFS copies every file of a directory from one file system to another,
+// the generic way.
+func copyFS(dst WritableFS, dstDir string, src fs.FS, srcDir string) error {
+	ents, err := fs.ReadDir(src, srcDir)
+	if err != nil {
+		return err
+	}
+	for _, ent := range ents {
+		buf, err := fs.ReadFile(src, path.Join(srcDir, ent.Name()))
+		if err != nil {
+			return err
+		}
+		info, err := ent.Info()
+		if err != nil {
+			return err
+		}
+		f, err := dst.OpenFile(path.Join(dstDir, ent.Name()), os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode())
+		if err != nil {
+			return err
+		}
+		if _, err = f.(WritableFile).Write(buf); err != nil {
+			f.Close()
+			return err
+		}
+		if err = f.Close(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestWritableFS(t *testing.T) {
+	src := fstest.MapFS{
+		"GAME":     {Data: []byte{1, 8, 0}, Mode: 0755},
+		"NOTE.SEQ": {Data: []byte("HELLO"), Mode: 0644},
+		"FIXED":    {Data: []byte("X"), Mode: 0444},
+	}
+	var d Img
+	d.Init("TEST", "01")
+	wfs := d.WritableFS(FlatRoot())
+	if err := copyFS(wfs, ".", src, "."); err != nil {
+		t.Fatal(err)
+	}
+	for name, typ := range map[string]FileType{"GAME": PRG, "NOTE": SEQ, "FIXED": LockSEQ} {
+		if ent := d.Lookup(name); ent == nil || ent.FileType != typ {
+			t.Errorf("%s: expected type %v, got %+v", name, typ, ent)
+		}
+	}
+	if err := fstest.TestFS(wfs, "GAME.PRG", "NOTE.SEQ", "FIXED.SEQ"); err != nil {
+		t.Error(err)
+	}
+
+	// copying again fails since the files exist
+	err := copyFS(wfs, ".", src, ".")
+	var dosErr *DOSError
+	if !errors.Is(err, fs.ErrExist) || !errors.Is(err, FileExists) || !errors.As(err, &dosErr) || dosErr.Code != 63 {
+		t.Errorf("expected a file exists error, got %v", err)
+	}
+	if err := wfs.Remove("FIXED.SEQ"); !errors.Is(err, fs.ErrPermission) {
+		t.Errorf("expected a permission error removing a locked file, got %v", err)
+	}
+	if err := wfs.Chmod("FIXED.SEQ", 0644); err != nil {
+		t.Error(err)
+	}
+	if err := wfs.Remove("FIXED.SEQ"); err != nil {
+		t.Error(err)
+	}
+	if err := wfs.Rename("NOTE.SEQ", "GAME.USR"); !errors.Is(err, fs.ErrExist) {
+		t.Errorf("expected rename over a file to fail, got %v", err)
+	}
+	if err := wfs.Rename("NOTE.SEQ", "TEXT.USR"); err != nil {
+		t.Error(err)
+	}
+	f, err := wfs.OpenFile("TEXT.USR", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.(WritableFile).Write([]byte(" WORLD")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if buf, _ := fs.ReadFile(wfs, "TEXT.USR"); string(buf) != "HELLO WORLD" {
+		t.Errorf("appended file holds %q", buf)
+	}
+	if _, err := wfs.OpenFile("NOPE", os.O_WRONLY, 0); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("expected ErrNotExist, got %v", err)
+	}
+
+	w, err := wfs.Create("BIG.PRG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(make([]byte, 700*254)); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); !errors.Is(err, DiskFull) || !strings.Contains(err.Error(), "72,DISK FULL") {
+		t.Errorf("expected disk full, got %v", err)
+	}
+	for i := 0; ; i++ {
+		w, err := wfs.Create(fmt.Sprintf("F%d.SEQ", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := w.Close(); err != nil {
+			if !errors.Is(err, DirFull) {
+				t.Errorf("expected directory full, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestImportFS(t *testing.T) {
+	p00 := append([]byte("C64File\x00GREETING"), make([]byte, 10)...)
+	src := fstest.MapFS{
+		"order.txt":                 {Data: []byte("# first\nsub/b.seq\n\nintro.prg\n")},
+		"intro.prg":                 {Data: []byte{1, 8}},
+		"sub/b.seq":                 {Data: []byte("B")},
+		"a very long file name.usr": {Data: []byte("A")},
+		"a very long file name.seq": {Data: []byte("A2")},
+		"x,y.p00":                   {Data: append(p00, 1, 8, 0)},
+		"readme":                    {Data: []byte("R")},
+		".hidden":                   {Data: []byte("H")},
+	}
+	var d Img
+	d.Init("TEST", "01")
+	ents, err := ImportFS(&d, src, &ImportOptions{Manifest: "order.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, ent := range ents {
+		got = append(got, fmt.Sprintf("%s.%s", ent.FilenameString(), ent.FileType))
+	}
+	want := []string{"B.SEQ", "INTRO.PRG", "A VERY LONG FILE.SEQ", "A VERY LONG FI~2.USR", "README.PRG", "GREETING.PRG"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("imported %q, want %q", got, want)
+	}
+	if buf, _ := d.ReadFile(d.Lookup("GREETING")); !bytes.Equal(buf, []byte{1, 8, 0}) {
+		t.Errorf("P00 contents are %v", buf)
+	}
+
+	// a file too big for the disk leaves the image as it was
+	before := d
+	src["huge.prg"] = &fstest.MapFile{Data: make([]byte, 700*254)}
+	if _, err := ImportFS(&d, src, nil); !errors.Is(err, DiskFull) {
+		t.Errorf("expected disk full, got %v", err)
+	}
+	if d != before {
+		t.Error("image changed by a failed import")
+	}
+}
+
+func TestBuild(t *testing.T) {
+	src := fstest.MapFS{
+		"intro.prg": {Data: append([]byte{1, 8}, make([]byte, 600)...)},
+		"notes.seq": {Data: []byte("HELLO")},
+		"big.prg":   {Data: make([]byte, 700*254)},
+	}
+	spec, err := ParseBuildSpec([]byte(`{
+		"name": "DEMO", "format": "d64",
+		"files": [
+			{"source": "intro.prg", "name": "INTRO", "interleave": 4, "track": 20, "locked": true},
+			{"separator": "----------------"},
+			{"source": "notes.seq"},
+			{"separator_hex": "a0a0"}
+		]
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := Build(spec, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := Build(spec, src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *d != *again {
+		t.Error("two builds of a spec differ")
+	}
+
+	var got []string
+	for _, ent := range d.Directory() {
+		got = append(got, fmt.Sprintf("%s.%s", ent.FilenameString(), ent.FileType))
+	}
+	want := []string{"INTRO.PRG", "----------------.DEL", "NOTES.SEQ", ".DEL"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("directory is %q, want %q", got, want)
+	}
+	ent := d.Lookup("INTRO")
+	if !ent.FileType.Locked() {
+		t.Error("INTRO is not locked")
+	}
+	chain, _ := d.Chain(ent.FileTS)
+	if len(chain) != 3 || chain[0].T != 20 || chain[1] != (TS{20, chain[0].S + 4}) {
+		t.Errorf("INTRO has chain %v", chain)
+	}
+	if bam := d.BAM(); string(bam.DiskID[:2]) != "00" {
+		t.Errorf("disk ID is %q", bam.DiskID)
+	}
+
+	for _, tc := range []struct {
+		spec string
+		err  string
+	}{
+		{`{"format": "d81"}`, "format D81 is not supported"},
+		{`{"id": "ABC"}`, "disk ID"},
+		{`{"files": [{"source": "missing.prg"}]}`, `files[0] "missing.prg"`},
+		{`{"files": [{"source": "intro.prg", "name": "SEVENTEEN CHARSXX"}]}`, "longer than 16"},
+		{`{"files": [{"source": "intro.prg", "track": 18}]}`, "start track 18"},
+		{`{"files": [{"source": "notes.seq"}, {"source": "notes.seq"}]}`, `files[1] "notes.seq": file exists`},
+		{`{"files": [{"source": "intro.prg"}, {"source": "big.prg"}]}`, "needs 700 blocks, 661 free"},
+		{`{"files": [{"nmae": "X"}]}`, "unknown field"},
+	} {
+		spec, err := ParseBuildSpec([]byte(tc.spec))
+		if err == nil {
+			_, err = Build(spec, src)
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s: got error %v, want %q", tc.spec, err, tc.err)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	var a, b Img
+	for _, d := range []*Img{&a, &b} {
+		d.Init("SAME", "01")
+		d.WriteFile("ONE", PRG, append([]byte{1, 8}, make([]byte, 300)...), nil)
+		d.WriteFile("TWO", SEQ, []byte("TEXT"), nil)
+		// GEOS keeps the hour and minute where the DOS keeps SaveReplace
+		info, _ := d.BAM().NewAllocator().Alloc()
+		geos, _ := d.WriteFile("GEOS APP", USR, []byte("CODE"), nil)
+		geos.RelSideSector, geos.Unused, geos.SaveReplace = info, [4]byte{6, 86, 1, 2}, TS{12, 30}
+		d.WriteFile("GONE", SEQ, []byte("OLD"), nil)
+		d.Remove("GONE", false)
+	}
+	// junk where the DOS does not look
+	b.BAM().Unused2[5] = 0x55
+	b.BAM().AvailMap[34].free[2] |= 0xE0
+	(*RawBlock)(b.Block(TS{1, 0})).Data[7] = 0x99
+	tail := (*RawBlock)(b.Block(b.Lookup("TWO").FileTS))
+	tail.Data[100] = 0x77
+	b.DirEntries()[1].DirLink = TS{3, 3}
+
+	if a == b {
+		t.Fatal("images equal before normalizing")
+	}
+	ha, _ := a.ContentHash()
+	hb, _ := b.ContentHash()
+	if ha != hb {
+		t.Error("junk changed the content hash")
+	}
+	a.Normalize()
+	b.Normalize()
+	if a != b {
+		t.Error("images differ after normalizing")
+	}
+	if a.Lookup("GONE") != nil || a.DirEntries()[3].Filename[0] != 0 {
+		t.Error("scratched entry not cleared")
+	}
+	if geos := a.Lookup("GEOS APP"); geos.SaveReplace != (TS{12, 30}) || geos.Unused != [4]byte{6, 86, 1, 2} {
+		t.Errorf("GEOS date lost: %+v", geos)
+	}
+	if buf, _ := a.ReadFile(a.Lookup("TWO")); string(buf) != "TEXT" {
+		t.Errorf("TWO reads %q after normalizing", buf)
+	}
+	for _, track := range a.BlockMap() {
+		for _, u := range track {
+			if u.Mismatch() {
+				t.Errorf("%v does not match the BAM after normalizing", u.TS)
+			}
+		}
+	}
+	if h, _ := a.ContentHash(); h != ha {
+		t.Error("normalizing changed the content hash")
+	}
+
+	// the same files elsewhere on the disk hash the same, other files do not
+	var c Img
+	c.Init("SAME", "01")
+	opts := &WriteOptions{Strategy: ProfileFill}
+	c.WriteFile("ONE", PRG, append([]byte{1, 8}, make([]byte, 300)...), opts)
+	c.WriteFile("TWO", SEQ, []byte("TEXT"), opts)
+	info, _ := c.BAM().NewAllocator().Alloc()
+	geos, _ := c.WriteFile("GEOS APP", USR, []byte("CODE"), opts)
+	geos.RelSideSector, geos.Unused = info, [4]byte{6, 86, 1, 2}
+	if h, _ := c.ContentHash(); h != ha {
+		t.Error("placement changed the content hash")
+	}
+	c.Lookup("TWO").FileType |= FlagLocked
+	if h, _ := c.ContentHash(); h == ha {
+		t.Error("locking did not change the content hash")
+	}
+}
+
+// writeVLIR adds a GEOS VLIR file with an info block and the records, where
+// an empty string is an empty record.
+func writeVLIR(t *testing.T, d *Img, name string, records ...string) *DirEntry {
+	t.Helper()
+	a := d.BAM().NewAllocator()
+	info, err := a.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	index, err := a.Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*blockBytes(d, info) = [blockSize]byte{1: 0xFF}
+	copy(blockBytes(d, info)[2:], "INFO")
+	idx := blockBytes(d, index)
+	*idx = [blockSize]byte{1: 0xFF}
+	for i, rec := range records {
+		pair := idx[2 + 2*i:]
+		if rec == "" {
+			pair[0], pair[1] = 0, 0xFF
+			continue
+		}
+		chain, err := d.writeChain(a, []byte(rec))
+		if err != nil {
+			t.Fatal(err)
+		}
+		pair[0], pair[1] = chain[0].T, chain[0].S
+	}
+	ent, err := d.NewDirEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: USR | FlagClosed, FileTS: index, RelSideSector: info, RelRecordSize: 1,
+		Unused: [4]byte{6, 86, 1, 2}}
+	ent.SetFilename(name)
+	return ent
+}
+
+func TestNormalizeVLIR(t *testing.T) {
+	// b holds the records of a in other blocks, c holds other records
+	var a, b, c Img
+	for _, d := range []*Img{&a, &b, &c} {
+		d.Init("SAME", "01")
+	}
+	b.WriteFile("MOVED", SEQ, make([]byte, 1000), nil)
+	writeVLIR(t, &a, "APP", "AAAA", "", "CODE")
+	writeVLIR(t, &b, "APP", "AAAA", "", "CODE")
+	writeVLIR(t, &c, "APP", "BBBB", "", "CODE")
+	b.Remove("MOVED", false)
+	ha, err := a.ContentHash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb, _ := b.ContentHash()
+	hc, _ := c.ContentHash()
+	if ha != hb {
+		t.Error("moving the records changed the content hash")
+	}
+	if ha == hc {
+		t.Error("records with other contents have the same hash")
+	}
+	info := a
+	blockBytes(&info, info.Lookup("APP").RelSideSector)[10] = 1
+	if h, _ := info.ContentHash(); h == ha {
+		t.Error("the info block is not hashed")
+	}
+
+	// the end of the last block of a record is cleared
+	rec := a.vlirRecords(a.Lookup("APP"))[2]
+	last := (*RawBlock)(a.Block(rec))
+	last.Data[100] = 0x77
+	if h, _ := a.ContentHash(); h != ha {
+		t.Error("bytes past the end of a record changed the hash")
+	}
+	a.Normalize()
+	if last.Data[100] != 0 {
+		t.Error("record tail not cleared")
+	}
+	if h, _ := a.ContentHash(); h != ha {
+		t.Error("normalizing changed the content hash")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	var a Img
+	a.Init("OLD", "01")
+	a.WriteFile("KEEP", PRG, []byte{1, 8, 1}, nil)
+	a.WriteFile("EDIT", SEQ, []byte("V1"), nil)
+	a.WriteFile("MOVE", SEQ, []byte("SAME"), nil)
+	a.WriteFile("DROP", USR, []byte("X"), nil)
+	b := a
+
+	df, err := Compare(&a, &b)
+	if err != nil || !df.Empty() {
+		t.Fatalf("an image differs from its copy: %+v %v", df, err)
+	}
+
+	copy(b.BAM().DiskName[:], PadString("NEW", 16))
+	b.WriteFile("EDIT", SEQ, []byte("V2"), &WriteOptions{Replace: true})
+	b.Rename("MOVE", "MOVED")
+	b.Remove("DROP", false)
+	b.WriteFile("ADD", PRG, []byte{1, 8}, nil)
+	b.Lookup("KEEP").FileType |= FlagLocked
+
+	df, err = Compare(&a, &b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, fd := range df.Files {
+		got = append(got, fmt.Sprintf("%s %s %s", fd.Op, fd.Path, fd.NewPath))
+	}
+	want := []string{
+		"added  ADD.PRG",
+		"removed DROP.USR ",
+		"changed EDIT.SEQ EDIT.SEQ",
+		"changed KEEP.PRG KEEP.PRG",
+		"renamed MOVE.SEQ MOVED.SEQ",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("file diffs are %q, want %q", got, want)
+	}
+	if len(df.Header) == 0 || df.Header[0] != (FieldDiff{"name", `"OLD"`, `"NEW"`}) {
+		t.Errorf("header diffs are %v", df.Header)
+	}
+	changed := make(map[TS]bool)
+	for _, ts := range df.Sectors {
+		changed[ts] = true
+	}
+	if !changed[TS{bamTrack, 0}] || !changed[TS{bamTrack, 1}] {
+		t.Errorf("sector diffs %v miss the BAM or the directory", df.Sectors)
+	}
+}
+
+func TestPatch(t *testing.T) {
+	var old Img
+	old.Init("GAME", "01")
+	old.WriteFile("MAIN", PRG, append([]byte{1, 8}, bytes.Repeat([]byte("CODE"), 200)...), nil)
+	fixed := old
+	buf, _ := fixed.ReadFile(fixed.Lookup("MAIN"))
+	buf[300] = 'X'
+	fixed.WriteFile("MAIN", PRG, buf, &WriteOptions{Replace: true})
+	fixed.WriteFile("README", SEQ, []byte("FIXED"), nil)
+
+	p, err := ParsePatch(MakePatch(&old, &fixed).Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := old
+	if err := p.Apply(&d); err != nil {
+		t.Fatal(err)
+	}
+	if d != fixed {
+		t.Error("patched image differs from the target")
+	}
+	if err := p.Apply(&d); !errors.Is(err, PatchMismatch) || !strings.Contains(err.Error(), "already patched") {
+		t.Errorf("applying twice gave %v", err)
+	}
+	other := old
+	other.WriteFile("EXTRA", SEQ, []byte("!"), nil)
+	before := other
+	if err := p.Apply(&other); !errors.Is(err, PatchMismatch) {
+		t.Errorf("applying to another image gave %v", err)
+	}
+	if other != before {
+		t.Error("a refused patch changed the image")
+	}
+
+	enc := p.Bytes()
+	enc[len(patchMagic) + 5] ^= 1
+	if _, err := ParsePatch(enc); !errors.Is(err, BadPatch) {
+		t.Errorf("corrupt patch gave %v", err)
+	}
+
+	// IPS and BPS round trips
+	ips, err := ParseIPS(p.IPS(), &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ips, p) {
+		t.Error("IPS round trip changed the patch")
+	}
+	bps, err := p.BPS(&old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if q, err := ParseBPS(bps, &old); err != nil || !reflect.DeepEqual(q, p) {
+		t.Errorf("BPS round trip changed the patch: %v", err)
+	}
+	if _, err := ParseBPS(bps, &other); !errors.Is(err, PatchMismatch) {
+		t.Errorf("BPS for another image gave %v", err)
+	}
+
+	// copy actions, which BPS writes itself
+	var enc2 bytes.Buffer
+	enc2.WriteString(bpsMagic)
+	for _, n := range []uint64{uint64(len(old)), uint64(len(old)), 0, 0<<2 | 1} {
+		bpsWriteNum(&enc2, n)
+	}
+	enc2.WriteByte(0x5A)
+	bpsWriteNum(&enc2, 8<<2|3) // TargetCopy 9 bytes from 0
+	bpsWriteNum(&enc2, 0)
+	bpsWriteNum(&enc2, uint64(len(old)-11)<<2|2) // SourceCopy the rest from 10
+	bpsWriteNum(&enc2, 10<<1)
+	want := old
+	copy(want[:10], "ZZZZZZZZZZ")
+	binary.Write(&enc2, binary.LittleEndian, crc32.ChecksumIEEE(old[:]))
+	binary.Write(&enc2, binary.LittleEndian, crc32.ChecksumIEEE(want[:]))
+	binary.Write(&enc2, binary.LittleEndian, crc32.ChecksumIEEE(enc2.Bytes()))
+	q, err := ParseBPS(enc2.Bytes(), &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = old
+	if q.Apply(&d); d != want {
+		t.Error("BPS copy actions gave the wrong image")
+	}
+}
+
+func TestCopyFile(t *testing.T) {
+	var src Img
+	src.Init("SRC", "01")
+	prg := append([]byte{1, 8}, bytes.Repeat([]byte("P"), 600)...)
+	src.WriteFile("PLAIN", PRG, prg, nil)
+	src.SetLocked("PLAIN", true)
+
+	// a REL file with two data blocks and a side sector
+	bam := src.BAM()
+	rel, _ := src.writeChain(bam.NewAllocator(), bytes.Repeat([]byte("R"), 300))
+	ss, _ := bam.NewAllocator().Alloc()
+	side := blockBytes(&src, ss)
+	side[0], side[1], side[2], side[3] = 0, 17, 0, 30
+	side[4], side[5] = ss.T, ss.S
+	side[16], side[17], side[18], side[19] = rel[0].T, rel[0].S, rel[1].T, rel[1].S
+	ent, _ := src.NewDirEntry()
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: REL | FlagClosed, FileTS: rel[0], RelSideSector: ss, RelRecordSize: 30}
+	ent.SetFilename("RECORDS")
+	ent.SetBlockCount(3)
+
+	// a GEOS VLIR file with an info block and one record
+	a := bam.NewAllocator()
+	info, _ := a.Alloc()
+	index, _ := a.Alloc()
+	rec, _ := src.writeChain(a, []byte("VLIR RECORD"))
+	blockBytes(&src, info)[1] = 0xFF
+	copy(blockBytes(&src, info)[2:], "INFO")
+	idx := blockBytes(&src, index)
+	idx[0], idx[1] = 0, 0xFF
+	idx[2], idx[3], idx[4], idx[5] = rec[0].T, rec[0].S, 0, 0xFF
+	ent, _ = src.NewDirEntry()
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: USR | FlagClosed, FileTS: index, RelSideSector: info, RelRecordSize: 1,
+		Unused: [4]byte{6, 86, 1, 2}, SaveReplace: TS{12, 30}}
+	ent.SetFilename("DESKTOP APP")
+	ent.SetBlockCount(3)
+
+	var dst Img
+	dst.Init("DST", "02")
+	dst.WriteFile("FILLER", SEQ, bytes.Repeat([]byte("F"), 2000), nil)
+	for _, name := range []string{"PLAIN", "RECORDS", "DESKTOP APP"} {
+		if _, err := CopyFile(&dst, &src, name, nil); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+	}
+
+	got := dst.Lookup("PLAIN")
+	if buf, _ := dst.ReadFile(got); !bytes.Equal(buf, prg) || !got.FileType.Locked() {
+		t.Errorf("PLAIN copied as %s with %d bytes", got.FileType, len(buf))
+	}
+	got = dst.Lookup("RECORDS")
+	if got.RelRecordSize != 30 || got.FileType.Base() != REL {
+		t.Errorf("RECORDS copied as %s with record size %d", got.FileType, got.RelRecordSize)
+	}
+	chain, _ := dst.Chain(got.FileTS)
+	nside := blockBytes(&dst, got.RelSideSector)
+	if len(chain) != 2 || nside[3] != 30 || (TS{nside[4], nside[5]}) != got.RelSideSector ||
+		(TS{nside[16], nside[17]}) != chain[0] || (TS{nside[18], nside[19]}) != chain[1] {
+		t.Errorf("side sector of RECORDS does not point to the copy: % x", nside[:20])
+	}
+	got = dst.Lookup("DESKTOP APP")
+	if !got.GEOS() || got.Unused != [4]byte{6, 86, 1, 2} || got.SaveReplace != (TS{12, 30}) {
+		t.Errorf("GEOS fields of DESKTOP APP not kept: %+v", got)
+	}
+	if !bytes.HasPrefix(blockBytes(&dst, got.RelSideSector)[2:], []byte("INFO")) {
+		t.Error("GEOS info block not copied")
+	}
+	nidx := blockBytes(&dst, got.FileTS)
+	if buf, _ := dst.ReadFile(&DirEntry{FileTS: TS{nidx[2], nidx[3]}}); string(buf) != "VLIR RECORD" || nidx[5] != 0xFF {
+		t.Errorf("VLIR record copied as %q", buf)
+	}
+
+	// copies keep the blocks of the source when they are free
+	var same Img
+	same.Init("DST", "02")
+	if _, err := CopyFile(&same, &src, "RECORDS", &CopyOptions{KeepLayout: true, Name: "KEPT"}); err != nil {
+		t.Fatal(err)
+	}
+	if kept := same.Lookup("KEPT"); kept.FileTS != rel[0] || kept.RelSideSector != ss {
+		t.Errorf("KeepLayout moved the file to %v", kept.FileTS)
+	}
+
+	if _, err := CopyFile(&dst, &src, "PLAIN", nil); !errors.Is(err, FileExists) {
+		t.Errorf("copying over a file gave %v", err)
+	}
+	dst.WriteFile("FULL", SEQ, make([]byte, 200*254), nil)
+	before := dst
+	src.WriteFile("HUGE", SEQ, make([]byte, 500*254), nil)
+	if _, err := CopyFile(&dst, &src, "HUGE", nil); !errors.Is(err, DiskFull) || dst.BAM().BlocksFree() != before.BAM().BlocksFree() {
+		t.Errorf("copying a file too big gave %v", err)
+	}
+}
+
+// writeREL stores a REL file with a single side sector, returning its data
+// blocks and the side sector.
+func writeREL(t *testing.T, d *Img, name string, data []byte, size uint8) ([]TS, TS) {
+	t.Helper()
+	bam := d.BAM()
+	chain, err := d.writeChain(bam.NewAllocator(), data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ss, err := bam.NewAllocator().Alloc()
+	if err != nil {
+		t.Fatal(err)
+	}
+	side := blockBytes(d, ss)
+	*side = [blockSize]byte{}
+	side[2], side[3] = 0, size
+	side[4], side[5] = ss.T, ss.S
+	for i, ts := range chain {
+		side[16 + 2*i], side[17 + 2*i] = ts.T, ts.S
+	}
+	(*RawBlock)(d.Block(ss)).EndFile(uint8(14 + 2*len(chain)))
+	ent, err := d.NewDirEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: REL | FlagClosed, FileTS: chain[0], RelSideSector: ss, RelRecordSize: size}
+	ent.SetFilename(name)
+	ent.SetBlockCount(uint16(len(chain) + 1))
+	return chain, ss
+}
+
+func TestValidateREL(t *testing.T) {
+	var d Img
+	d.Init("REL", "01")
+	d.WriteFile("PLAIN", SEQ, []byte("TEXT"), nil)
+	chain, ss := writeREL(t, &d, "RECORDS", bytes.Repeat([]byte("R"), 300), 30)
+	bam := d.BAM()
+	bam.Free(chain[1]) // a stray free block for Validate to repair
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	if bam.Avail(ss) || bam.Avail(chain[1]) {
+		t.Error("Validate freed blocks of the REL file")
+	}
+	free := bam.BlocksFree()
+	if err := d.Remove("RECORDS", false); err != nil {
+		t.Fatal(err)
+	}
+	if bam.BlocksFree() != free + 3 || !bam.Avail(ss) {
+		t.Error("scratching the REL file left its side sector allocated")
+	}
+}
@@ -1,208 +1,553 @@
 package disk
 
 import (
+	"fmt"
 	"io"
 	"io/fs"
-	"fmt"
 	"path"
 	"sort"
+	"strings"
 	"time"
 )
 
-type rootFileInfo string
+// ExtScheme chooses the extensions the files of an FS get.
+type ExtScheme int
+
+const (
+	// ExtType appends the file type, as in "GAME.PRG".
+	ExtType ExtScheme = iota
+	// ExtNone uses the bare file name.
+	ExtNone
+	// ExtP00 stores each file in a PC64 container named like "GAME.P00",
+	// where the number counts up for files with the same name.
+	ExtP00
+)
+
+// NamePolicy chooses what happens to characters of a file name which can not
+// be used in a path, such as '/' or the PETSCII graphics.
+type NamePolicy int
+
+const (
+	// NameEscape writes the byte in hexadecimal after a '%', as in "A%2FB".
+	NameEscape NamePolicy = iota
+	// NameReplace turns the byte into an '_'.
+	NameReplace
+	// NameSkip leaves the file out.
+	NameSkip
+)
 
-func (di *rootFileInfo) Name() string { return *(*string)(di) }
-func (di *rootFileInfo) Size() int64 { return 0 }
-func (di *rootFileInfo) Mode() fs.FileMode { return fs.ModeDir | 0777 }
-func (di *rootFileInfo) ModTime() time.Time { return time.Time{} }
-func (di *rootFileInfo) IsDir() bool { return true }
-func (di *rootFileInfo) Sys() interface{} { return nil }
+// DupPolicy chooses what happens when two files get the same path.
+type DupPolicy int
 
-type FileDirEntry interface {
-	fs.File
-	fs.DirEntry
+const (
+	// DupSuffix adds "~2", "~3" and so on to the later files.
+	DupSuffix DupPolicy = iota
+	// DupFirst only keeps the first file in directory order.
+	DupFirst
+)
+
+type fsConfig struct {
+	flat bool
+	ext ExtScheme
+	names NamePolicy
+	dups DupPolicy
+	cbmGlob bool
+}
+
+// FSOption changes the layout of the file system returned by Img.FS.
+type FSOption func(*fsConfig)
+
+// FlatRoot puts the files in the root of the file system instead of in a
+// directory named after the disk.
+func FlatRoot() FSOption {
+	return func(c *fsConfig) { c.flat = true }
 }
 
+// Extensions sets the extension scheme. The default is ExtType.
+func Extensions(ext ExtScheme) FSOption {
+	return func(c *fsConfig) { c.ext = ext }
+}
+
+// Names sets the policy for characters which can not be used in a path. The
+// default is NameEscape.
+func Names(p NamePolicy) FSOption {
+	return func(c *fsConfig) { c.names = p }
+}
+
+// Duplicates sets the policy for files which end up with the same path. The
+// default is DupSuffix.
+func Duplicates(p DupPolicy) FSOption {
+	return func(c *fsConfig) { c.dups = p }
+}
+
+// CBMGlob makes Glob match the file part of a pattern with CBM wildcards, the
+// same way the 1541 does, instead of the syntax of path.Match. A type may
+// follow the name, as in "DISK/DEMO*,P". It is an option because
+// fstest.TestFS checks Glob against path.Match, with character classes,
+// escapes and a '*' in the middle of a pattern, which CBM patterns do not
+// have.
+func CBMGlob() FSOption {
+	return func(c *fsConfig) { c.cbmGlob = true }
+}
+
+// defaultDirName is used when the disk name is empty.
+const defaultDirName = "disk"
+
+// p00Magic starts the header of a PC64 container, which is followed by the
+// name of the file, a zero and the record size of a REL file.
+const p00Magic = "C64File\x00"
+
 type diskFS struct {
-	disk *Img;
-	name string;
-	files map[string]FileDirEntry;
+	disk *Img
+	conf fsConfig
 }
 
-type rootFile string
+// FS returns a read-only file system holding the files of the disk. By default
+// the files are in a directory named after the disk and have their type as an
+// extension. The file system follows changes to the image.
+func (d *Img) FS(opts ...FSOption) fs.FS {
+	dfs := &diskFS{disk: d}
+	for _, opt := range opts {
+		opt(&dfs.conf)
+	}
+	return dfs
+}
 
-func (nf *rootFile) Stat() (fs.FileInfo, error) { return (*rootFileInfo)(nf), nil }
-func (nf *rootFile) Read(_ []byte) (int, error) { return 0, io.EOF }
-func (nf *rootFile) Close() error { return nil }
+// fsFile is a file of the file system.
+type fsFile struct {
+	name string
+	entry *DirEntry
+	// header is prepended to the contents, for ExtP00.
+	header []byte
+}
 
-func (dfs *diskFS) Open(name string) (fs.File, error) {
-	if name == "." {
-		return (*rootFile)(&name), nil
+// dirName returns the name of the directory holding the files, which is
+// empty for a flat root.
+func (dfs *diskFS) dirName() string {
+	if dfs.conf.flat {
+		return ""
 	}
-	dir, file := path.Split(name)
-	switch {
-	case dir == dfs.name + "/":
-		if ent := dfs.files[file]; ent != nil {
-			return ent, nil
+	bam := dfs.disk.BAM()
+	name, ok := dfs.pathName(bam.DiskName[:nameLen(bam.DiskName[:])])
+	if ok {
+		name, ok = dfs.validName(name)
+	}
+	if !ok || name == "" {
+		return defaultDirName
+	}
+	return name
+}
+
+// pathName converts a name from the disk into a path element. Returns false if
+// the policy leaves the name out.
+func (dfs *diskFS) pathName(name []byte) (string, bool) {
+	var sb strings.Builder
+	for _, c := range name {
+		if c >= 0x20 && c < 0x7F && c != '/' && c != '%' {
+			sb.WriteByte(c)
+			continue
+		}
+		switch dfs.conf.names {
+		case NameEscape:
+			fmt.Fprintf(&sb, "%%%02X", c)
+		case NameReplace:
+			sb.WriteByte('_')
+		default:
+			return "", false
 		}
-	case dir == "" && file == dfs.name:
-		return (*rootFile)(&file), nil
 	}
-	return nil, &fs.PathError{"open", name, fs.ErrNotExist}
+	return sb.String(), true
 }
 
-func (dfs *diskFS) ReadDir(name string) ([]fs.DirEntry, error) {
-	if name == "." {
-		entry := fs.FileInfoToDirEntry((*rootFileInfo)(&dfs.name))
-		return []fs.DirEntry{entry}, nil
+// validName makes sure a whole path element is neither "." nor "..", which
+// are the only names left that fs.ValidPath rejects.
+func (dfs *diskFS) validName(s string) (string, bool) {
+	if s != "." && s != ".." {
+		return s, true
 	}
-	if name != dfs.name {
-		return nil, fs.ErrNotExist
+	switch dfs.conf.names {
+	case NameEscape:
+		return strings.ReplaceAll(s, ".", "%2E"), true
+	case NameReplace:
+		return strings.ReplaceAll(s, ".", "_"), true
 	}
+	return "", false
+}
 
-	var entries []fs.DirEntry
-	for _, file := range dfs.files {
-		finfo, err := file.Stat()
-		if err != nil {
-			return nil, err
+// list returns the files of the disk, sorted by name.
+func (dfs *diskFS) list() []*fsFile {
+	var files []*fsFile
+	taken := make(map[string]bool)
+	for _, ent := range dfs.disk.DirEntries() {
+		// separators in the listing have no blocks to read
+		if ent.IsScratched() || !ent.FileTS.IsValid() {
+			continue
+		}
+		raw := ent.Filename[:]
+		if i := len(UnpadBytes(raw)); i < len(raw) {
+			raw = raw[:i]
+		}
+		stem, ok := dfs.pathName(raw)
+		if !ok {
+			continue
 		}
-		entries = append(entries, fs.FileInfoToDirEntry(finfo))
+		f := &fsFile{entry: ent}
+		switch dfs.conf.ext {
+		case ExtType:
+			f.name = fmt.Sprintf("%s.%s", stem, ent.FileType)
+		case ExtNone:
+			f.name = stem
+		case ExtP00:
+			letter := ent.FileType.String()[0]
+			for n := 0; n < 100; n++ {
+				f.name = fmt.Sprintf("%s.%c%02d", stem, letter, n)
+				if !taken[f.name] {
+					break
+				}
+			}
+			f.header = append([]byte(p00Magic), ent.Filename[:]...)
+			for i := len(p00Magic); i < len(f.header); i++ {
+				if f.header[i] == padByte {
+					f.header[i] = 0
+				}
+			}
+			f.header = append(f.header, 0, ent.RelRecordSize)
+		}
+		if f.name, ok = dfs.validName(f.name); !ok || f.name == "" {
+			continue
+		}
+		if taken[f.name] {
+			if dfs.conf.dups == DupFirst {
+				continue
+			}
+			ext := path.Ext(f.name)
+			base := strings.TrimSuffix(f.name, ext)
+			for n := 2; taken[f.name]; n++ {
+				f.name = fmt.Sprintf("%s~%d%s", base, n, ext)
+			}
+		}
+		taken[f.name] = true
+		files = append(files, f)
 	}
-	sort.Slice(entries, func (i, j int) bool {
-		return entries[i].Name() < entries[j].Name()
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].name < files[j].name
 	})
-	return entries, nil
+	return files
 }
 
-type dirEntryFile struct {
-	disk *Img;
-	entry *DirEntry;
-	iter FileBlock;
-	offset int;
+// lookup splits a valid path into a directory and a file name and finds what
+// it names. The root and the directory of the disk give a nil file.
+func (dfs *diskFS) lookup(name string) (*fsFile, bool) {
+	dir := dfs.dirName()
+	var file string
+	switch {
+	case name == ".":
+		return nil, true
+	case dir == "":
+		file = name
+	case name == dir:
+		return nil, true
+	case strings.HasPrefix(name, dir + "/"):
+		file = name[len(dir)+1:]
+	default:
+		return nil, false
+	}
+	for _, f := range dfs.list() {
+		if f.name == file {
+			return f, true
+		}
+	}
+	return nil, false
 }
 
-// fs.File methods
+func (dfs *diskFS) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	f, ok := dfs.lookup(name)
+	if !ok {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	if f == nil {
+		entries, _ := dfs.ReadDir(name)
+		return &dirHandle{info: dirInfo(path.Base(name)), entries: entries}, nil
+	}
+	l := f.layout(dfs.disk)
+	return &fileHandle{
+		disk: dfs.disk,
+		info: &fileInfo{f, l.size},
+		layout: l,
+	}, nil
+}
 
-func (def *dirEntryFile) Stat() (fs.FileInfo, error) {
-	return def, nil
+func (dfs *diskFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	f, ok := dfs.lookup(name)
+	switch {
+	case !ok:
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrNotExist}
+	case f != nil:
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	case name == "." && !dfs.conf.flat:
+		return []fs.DirEntry{fs.FileInfoToDirEntry(dirInfo(dfs.dirName()))}, nil
+	}
+	var entries []fs.DirEntry
+	for _, f := range dfs.list() {
+		entries = append(entries, &fileInfo{f, f.layout(dfs.disk).size})
+	}
+	return entries, nil
 }
 
-// Read exports a disk file entry to external file data.
+// Stat describes a file or directory without opening it.
+func (dfs *diskFS) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	f, ok := dfs.lookup(name)
+	switch {
+	case !ok:
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrNotExist}
+	case f == nil:
+		return dirInfo(path.Base(name)), nil
+	}
+	return &fileInfo{f, f.layout(dfs.disk).size}, nil
+}
 
-func (f *dirEntryFile) Read(dest []byte) (int, error) {
-	var read int
-	for read < len(dest) {
-		blk := f.iter.Bytes()
-		if len(blk) == 0 {
-			return read, io.EOF
+// ReadFile returns the contents of a file, reading its chain once.
+func (dfs *diskFS) ReadFile(name string) ([]byte, error) {
+	f, err := dfs.Open(name)
+	if err != nil {
+		if pe, ok := err.(*fs.PathError); ok {
+			pe.Op = "readfile"
 		}
-		n := copy(dest[read:], blk[f.offset:])
-		read += n
-		if n < len(blk) {
-			f.offset = n
-			break
+		return nil, err
+	}
+	fh, ok := f.(*fileHandle)
+	if !ok {
+		return nil, &fs.PathError{Op: "readfile", Path: name, Err: fs.ErrInvalid}
+	}
+	buf := make([]byte, fh.layout.size)
+	n, err := fh.ReadAt(buf, 0)
+	if err == io.EOF {
+		err = nil
+	}
+	if err != nil {
+		err = &fs.PathError{Op: "readfile", Path: name, Err: err}
+	}
+	return buf[:n], err
+}
+
+// Sub returns the file system rooted at a directory. The directory of the disk
+// gives the flat layout.
+func (dfs *diskFS) Sub(dir string) (fs.FS, error) {
+	if !fs.ValidPath(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	}
+	f, ok := dfs.lookup(dir)
+	switch {
+	case !ok:
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrNotExist}
+	case f != nil:
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrInvalid}
+	case dir == ".":
+		return dfs, nil
+	}
+	sub := *dfs
+	sub.conf.flat = true
+	return &sub, nil
+}
+
+// Glob matches patterns with the syntax of path.Match, as fs.Glob does, unless
+// the file system was made with CBMGlob.
+func (dfs *diskFS) Glob(pattern string) ([]string, error) {
+	if !dfs.conf.cbmGlob {
+		// hide this method so fs.Glob does not call it again
+		return fs.Glob(struct{ fs.ReadDirFS }{dfs}, pattern)
+	}
+	dir, file := path.Split(pattern)
+	spec, err := ParseOpen(file)
+	if err != nil {
+		return nil, path.ErrBadPattern
+	}
+	var matches []string
+	root := dfs.dirName()
+	switch {
+	case dir == "" && root != "":
+		var name [16]byte
+		copy(name[:], PadString(root, len(name)))
+		if len(root) <= len(name) && MatchName([]byte(spec.Pattern), name) {
+			matches = append(matches, root)
 		}
-		f.offset = 0
-		next := f.iter.NextBlock(f.disk)
-		if next == nil {
-			return read, io.EOF
+	case dir == "" || dir == root + "/":
+		for _, f := range dfs.list() {
+			if spec.Match(f.entry) {
+				matches = append(matches, dir + f.name)
+			}
 		}
-		f.iter = next
 	}
-	return read, nil
+	return matches, nil
 }
 
-func (def *dirEntryFile) Close() error {
-	return nil
+// dirInfo describes a directory.
+type dirInfo string
+
+func (di dirInfo) Name() string { return string(di) }
+func (di dirInfo) Size() int64 { return 0 }
+func (di dirInfo) Mode() fs.FileMode { return fs.ModeDir | 0555 }
+func (di dirInfo) ModTime() time.Time { return time.Time{} }
+func (di dirInfo) IsDir() bool { return true }
+func (di dirInfo) Sys() interface{} { return nil }
+
+// dirHandle is an open directory.
+type dirHandle struct {
+	info dirInfo
+	entries []fs.DirEntry
 }
 
-// fs.FileInfo methods
+func (dh *dirHandle) Stat() (fs.FileInfo, error) { return dh.info, nil }
+func (dh *dirHandle) Close() error { return nil }
 
-func (def *dirEntryFile) Name() string {
-	var name, ext string
-	name = UnpadBytes(def.entry.Filename[:])
-	switch def.entry.FileType {
-		case DEL: ext = "DEL"
-		case SEQ: ext = "SEQ"
-		case PRG: ext = "PRG"
-		case USR: ext = "USR"
-		case REL: ext = "REL"
-		default: ext = "???"
-	}
-	return fmt.Sprintf("%s.%s", name, ext)
+func (dh *dirHandle) Read(_ []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: string(dh.info), Err: fs.ErrInvalid}
 }
 
-func (def *dirEntryFile) Size() int64 {
-	var n int64
-	for iter := def.entry.FileBlock(def.disk); iter != nil; iter = iter.NextBlock(def.disk) {
-		n += int64(iter.Len())
+func (dh *dirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	if n <= 0 {
+		entries := dh.entries
+		dh.entries = nil
+		return entries, nil
+	}
+	if len(dh.entries) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(dh.entries) {
+		n = len(dh.entries)
 	}
-	return n
+	entries := dh.entries[:n]
+	dh.entries = dh.entries[n:]
+	return entries, nil
+}
+
+// fileInfo describes a file. It is also the fs.DirEntry of the file.
+type fileInfo struct {
+	file *fsFile
+	size int64
 }
 
-func (def *dirEntryFile) Type() fs.FileMode {
-	return 0
+func (fi *fileInfo) Name() string {
+	return fi.file.name
 }
 
-func (def *dirEntryFile) Info() (fs.FileInfo, error) {
-	return def, nil
+func (fi *fileInfo) Size() int64 {
+	return fi.size
 }
 
-func (def *dirEntryFile) Mode() fs.FileMode {
-	if def.entry.FileType == PRG {
-		return 0755
-	} else {
-		return 0644
+func (fi *fileInfo) Mode() fs.FileMode {
+	mode := fs.FileMode(0644)
+	if fi.file.entry.FileType.Base() == PRG {
+		mode = 0755
 	}
+	if fi.file.entry.FileType.Locked() {
+		mode &^= 0222
+	}
+	return mode
 }
 
-func (def *dirEntryFile) ModTime() time.Time {
-	return time.Time{}
+func (fi *fileInfo) ModTime() time.Time { return time.Time{} }
+func (fi *fileInfo) IsDir() bool { return false }
+func (fi *fileInfo) Sys() interface{} { return fi.file.entry }
+func (fi *fileInfo) Type() fs.FileMode { return 0 }
+func (fi *fileInfo) Info() (fs.FileInfo, error) { return fi, nil }
+
+// fileLayout is where the contents of a file are: the blocks of its chain and
+// the offset of the first byte of each block, after the header. A broken chain
+// is followed as far as it goes and the error is kept for the reader.
+type fileLayout struct {
+	chain []TS
+	offsets []int64
+	size int64
+	err error
 }
 
-func (def *dirEntryFile) IsDir() bool {
-	return false
+func (f *fsFile) layout(d *Img) *fileLayout {
+	l := new(fileLayout)
+	l.chain, l.err = d.Chain(f.entry.FileTS)
+	l.size = int64(len(f.header))
+	for _, ts := range l.chain {
+		l.offsets = append(l.offsets, l.size)
+		l.size += int64((*RawBlock)(d.Block(ts)).Len())
+	}
+	return l
 }
 
-func (def *dirEntryFile) Sys() interface{} {
-	return def.entry
+// fileHandle is an open file. Each Open returns its own handle, so the same
+// file can be read several times at once. It implements io.Seeker and
+// io.ReaderAt.
+type fileHandle struct {
+	disk *Img
+	info *fileInfo
+	layout *fileLayout
+	pos int64
 }
 
-func (d *Img) FS() fs.FS {
-	bam := d.BAM()
-	name := UnpadBytes(bam.DiskName[:])
-	return &diskFS{d, name, loadDirEntries(d)}
+func (fh *fileHandle) Stat() (fs.FileInfo, error) { return fh.info, nil }
+func (fh *fileHandle) Close() error { return nil }
+
+// Read exports the contents of a file, after its header.
+func (fh *fileHandle) Read(dest []byte) (int, error) {
+	n, err := fh.ReadAt(dest, fh.pos)
+	fh.pos += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
 }
 
-func loadDirEntries(d *Img) map[string]FileDirEntry {
-	files := make(map[string]FileDirEntry)
-	dir := d.Dir()
-	for {
-		for i := range dir.Files {
-			ent := &dir.Files[i]
-			entfile := newDirEntryFile(d, ent)
-			if entfile == nil {
-				continue
+// ReadAt reads from any offset in the file. The block holding it is found from
+// the offsets cached when the file was opened.
+func (fh *fileHandle) ReadAt(dest []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: fh.info.Name(), Err: fs.ErrInvalid}
+	}
+	header := fh.info.file.header
+	l := fh.layout
+	var n int
+	for n < len(dest) {
+		pos := off + int64(n)
+		if pos >= l.size {
+			if l.err != nil {
+				return n, l.err
 			}
-			files[entfile.Name()] = entfile
+			return n, io.EOF
 		}
-		ts, ok := dir.Next()
-		if !ok {
-			break
+		if pos < int64(len(header)) {
+			n += copy(dest[n:], header[pos:])
+			continue
 		}
-		dir = (*DirBlock)(d.Block(ts))
+		i := sort.Search(len(l.offsets), func(i int) bool {
+			return l.offsets[i] > pos
+		}) - 1
+		data := (*RawBlock)(fh.disk.Block(l.chain[i])).Bytes()
+		n += copy(dest[n:], data[pos-l.offsets[i]:])
 	}
-	return files
+	return n, nil
 }
 
-func newDirEntryFile(d *Img, entry *DirEntry) FileDirEntry {
-	if entry.IsScratched() {
-		return nil
+func (fh *fileHandle) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += fh.pos
+	case io.SeekEnd:
+		offset += fh.layout.size
+	default:
+		offset = -1
 	}
-	blk := entry.FileBlock(d)
-	return &dirEntryFile{
-		disk: d,
-		entry: entry,
-		iter: blk,
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: fh.info.Name(), Err: fs.ErrInvalid}
 	}
+	fh.pos = offset
+	return offset, nil
 }
@@ -0,0 +1,363 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+)
+
+// Error codes of the DOS error channel.
+const (
+	dosOK = 0
+	dosFilesScratched = 1
+	dosWriteProtect = 26
+	dosSyntaxError = 30
+	dosInvalidCommand = 31
+	dosNoFilename = 34
+	dosFileNotFound = 62
+	dosFileExists = 63
+	dosNoBlock = 65
+	dosIllegalTS = 66
+	dosDirError = 71
+	dosDiskFull = 72
+	dosVersion = 73
+)
+
+var dosMessages = map[int]string{
+	// The 1541 really does print a space before OK.
+	dosOK: " OK",
+	dosFilesScratched: "FILES SCRATCHED",
+	dosWriteProtect: "WRITE PROTECT ON",
+	dosSyntaxError: "SYNTAX ERROR",
+	dosInvalidCommand: "SYNTAX ERROR",
+	dosNoFilename: "SYNTAX ERROR",
+	dosFileNotFound: "FILE NOT FOUND",
+	dosFileExists: "FILE EXISTS",
+	dosNoBlock: "NO BLOCK",
+	dosIllegalTS: "ILLEGAL TRACK OR SECTOR",
+	dosDirError: "DIR ERROR",
+	dosDiskFull: "DISK FULL",
+	dosVersion: "CBM DOS V2.6 1541",
+}
+
+// DOSError is a message from the error channel of the drive.
+type DOSError struct {
+	Code int
+	Msg string
+	T, S uint8
+	// err is the error of this package the message was made from.
+	err error
+}
+
+func newDOSError(code int, t, s uint8) *DOSError {
+	return &DOSError{code, dosMessages[code], t, s, nil}
+}
+
+// Unwrap returns the error of this package the message was made from, such as
+// DirFull, if there is one.
+func (e *DOSError) Unwrap() error {
+	return e.err
+}
+
+// Is matches the errors of io/fs that mean the same as the code, so generic
+// code can check for fs.ErrExist and the like.
+func (e *DOSError) Is(target error) bool {
+	switch e.Code {
+	case dosFileNotFound:
+		return target == fs.ErrNotExist
+	case dosFileExists:
+		return target == fs.ErrExist
+	case dosWriteProtect:
+		return target == fs.ErrPermission
+	case dosSyntaxError, dosInvalidCommand, dosNoFilename:
+		return target == fs.ErrInvalid
+	}
+	return false
+}
+
+// Error formats the error the same way the drive sends it over the error
+// channel.
+func (e *DOSError) Error() string {
+	return fmt.Sprintf("%02d,%s,%02d,%02d", e.Code, e.Msg, e.T, e.S)
+}
+
+// toDOSError converts errors of this package to the closest DOS error. A BAM
+// or directory that does not match the chains on the disk is a DIR ERROR, as
+// the drive reports it. Other errors, such as a name that is too long, are
+// syntax errors.
+func toDOSError(err error) *DOSError {
+	var dosErr *DOSError
+	var code int
+	switch {
+	case err == nil:
+		return newDOSError(dosOK, 0, 0)
+	case errors.As(err, &dosErr):
+		return dosErr
+	case errors.Is(err, FileNotFound):
+		code = dosFileNotFound
+	case errors.Is(err, FileExists):
+		code = dosFileExists
+	case errors.Is(err, FileLocked):
+		code = dosWriteProtect
+	case errors.Is(err, DiskFull), errors.Is(err, DirFull):
+		// the drive reports a full directory as a full disk
+		code = dosDiskFull
+	case errors.Is(err, BadTS), errors.Is(err, ChainLoop), errors.Is(err, OutOfRange):
+		code = dosIllegalTS
+	case errors.Is(err, BAMConflict), errors.Is(err, ChainClash), errors.Is(err, BadIndex):
+		code = dosDirError
+	default:
+		code = dosSyntaxError
+	}
+	dosErr = newDOSError(code, 0, 0)
+	dosErr.err = err
+	return dosErr
+}
+
+// DOS interprets the commands a 1541 accepts over its command channel (15) and
+// runs them against a disk image.
+type DOS struct {
+	img *Img
+	buffers map[int]*[blockSize]byte
+}
+
+func NewDOS(d *Img) *DOS {
+	return &DOS{d, make(map[int]*[blockSize]byte)}
+}
+
+// Buffer returns the block buffer of a channel, which is filled by U1 and
+// written by U2.
+func (dos *DOS) Buffer(ch int) []byte {
+	buf := dos.buffers[ch]
+	if buf == nil {
+		buf = new([blockSize]byte)
+		dos.buffers[ch] = buf
+	}
+	return buf[:]
+}
+
+// Command runs a single command and returns the message from the error
+// channel, such as "00, OK,00,00".
+func (dos *DOS) Command(cmd string) string {
+	return dos.run(strings.TrimRight(cmd, "\r")).Error()
+}
+
+func (dos *DOS) run(cmd string) *DOSError {
+	if cmd == "" {
+		return newDOSError(dosInvalidCommand, 0, 0)
+	}
+	switch {
+	case strings.HasPrefix(cmd, "B-A"):
+		return dos.blockAlloc(cmd[3:], true)
+	case strings.HasPrefix(cmd, "B-F"):
+		return dos.blockAlloc(cmd[3:], false)
+	case strings.HasPrefix(cmd, "U1"), strings.HasPrefix(cmd, "UA"):
+		return dos.blockIO(cmd[2:], false)
+	case strings.HasPrefix(cmd, "U2"), strings.HasPrefix(cmd, "UB"):
+		return dos.blockIO(cmd[2:], true)
+	case strings.HasPrefix(cmd, "UI"), strings.HasPrefix(cmd, "UJ"):
+		return newDOSError(dosVersion, 0, 0)
+	}
+
+	// Only the first letter of the other commands matters, so "SCRATCH0:" is
+	// the same as "S0:".
+	arg := ""
+	if i := strings.IndexByte(cmd, ':'); i >= 0 {
+		arg = cmd[i+1:]
+	}
+	switch cmd[0] {
+	case 'I':
+		return newDOSError(dosOK, 0, 0)
+	case 'V':
+		return toDOSError(dos.img.Validate())
+	case 'N':
+		return dos.format(arg)
+	case 'S':
+		return dos.scratch(arg)
+	case 'R':
+		return dos.rename(arg)
+	case 'C':
+		return dos.copy(arg)
+	}
+	return newDOSError(dosInvalidCommand, 0, 0)
+}
+
+// format handles N0:NAME,ID. Without an ID only the directory and BAM are
+// cleared.
+func (dos *DOS) format(arg string) *DOSError {
+	name, id := arg, ""
+	if i := strings.IndexByte(arg, ','); i >= 0 {
+		name, id = arg[:i], arg[i+1:]
+	}
+	if name == "" {
+		return newDOSError(dosNoFilename, 0, 0)
+	}
+	if len(name) > 16 {
+		name = name[:16]
+	}
+	d := dos.img
+	if id == "" {
+		id = string(d.BAM().DiskID[:2])
+		for _, ts := range []TS{{bamTrack, 0}, {bamTrack, 1}} {
+			*(*[blockSize]byte)(d.Block(ts)) = [blockSize]byte{}
+		}
+	} else {
+		if len(id) > 2 {
+			id = id[:2]
+		}
+		*d = Img{}
+	}
+	if err := d.Init(name, string(PadString(id, 2))); err != nil {
+		return newDOSError(dosSyntaxError, 0, 0)
+	}
+	return newDOSError(dosOK, 0, 0)
+}
+
+// scratch handles S0:PATTERN[,PATTERN...]. Locked files are skipped.
+func (dos *DOS) scratch(arg string) *DOSError {
+	if arg == "" {
+		return newDOSError(dosNoFilename, 0, 0)
+	}
+	var n uint8
+	for _, pattern := range strings.Split(arg, ",") {
+		pattern = stripDrive(pattern)
+		for _, ent := range dos.img.DirEntries() {
+			if ent.IsScratched() || ent.FileType.Locked() {
+				continue
+			}
+			if MatchName([]byte(pattern), ent.Filename) {
+				dos.img.scratch(ent)
+				n++
+			}
+		}
+	}
+	return newDOSError(dosFilesScratched, n, 0)
+}
+
+// rename handles R0:NEW=OLD.
+func (dos *DOS) rename(arg string) *DOSError {
+	i := strings.IndexByte(arg, '=')
+	if i <= 0 || i == len(arg)-1 {
+		return newDOSError(dosNoFilename, 0, 0)
+	}
+	oldname := stripDrive(arg[i+1:])
+	return toDOSError(dos.img.Rename(oldname, arg[:i]))
+}
+
+// copy handles C0:NEW=OLD1[,OLD2...], which concatenates files into a new
+// file with the type of the first one.
+func (dos *DOS) copy(arg string) *DOSError {
+	i := strings.IndexByte(arg, '=')
+	if i <= 0 || i == len(arg)-1 {
+		return newDOSError(dosNoFilename, 0, 0)
+	}
+	d := dos.img
+	newname := arg[:i]
+	if d.Lookup(newname) != nil {
+		return newDOSError(dosFileExists, 0, 0)
+	}
+	var data bytes.Buffer
+	var typ FileType
+	for _, name := range strings.Split(arg[i+1:], ",") {
+		ent := d.Lookup(stripDrive(name))
+		if ent == nil {
+			return newDOSError(dosFileNotFound, 0, 0)
+		}
+		if typ == 0 {
+			typ = ent.FileType.Base()
+		}
+		buf, err := d.ReadFile(ent)
+		if err != nil {
+			return toDOSError(err)
+		}
+		data.Write(buf)
+	}
+	opts := &WriteOptions{Strategy: ROMStrategy{SectorFileStagger}}
+	_, err := d.WriteFile(newname, typ, data.Bytes(), opts)
+	return toDOSError(err)
+}
+
+// stripDrive removes the drive number from names like "0:FILE".
+func stripDrive(name string) string {
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		return name[i+1:]
+	}
+	return name
+}
+
+// dosArgs splits the numeric parameters of the block commands. The DOS accepts
+// spaces, commas and cursor right as separators.
+func dosArgs(arg string, n int) ([]int, bool) {
+	arg = strings.TrimPrefix(arg, ":")
+	fields := strings.FieldsFunc(arg, func(r rune) bool {
+		return r == ' ' || r == ',' || r == ':' || r == 0x1D
+	})
+	if len(fields) != n {
+		return nil, false
+	}
+	nums := make([]int, n)
+	for i, f := range fields {
+		x, err := strconv.Atoi(f)
+		if err != nil || x < 0 || x > 255 {
+			return nil, false
+		}
+		nums[i] = x
+	}
+	return nums, true
+}
+
+// blockAlloc handles B-A and B-F with the parameters drive, track and sector.
+// When a block to allocate is taken the DOS replies with the next free block.
+func (dos *DOS) blockAlloc(arg string, alloc bool) *DOSError {
+	nums, ok := dosArgs(arg, 3)
+	if !ok {
+		return newDOSError(dosSyntaxError, 0, 0)
+	}
+	ts := TS{uint8(nums[1]), uint8(nums[2])}
+	if !ts.IsValid() {
+		return newDOSError(dosIllegalTS, ts.T, ts.S)
+	}
+	bam := dos.img.BAM()
+	if !alloc {
+		if !bam.Avail(ts) {
+			bam.Free(ts)
+		}
+		return newDOSError(dosOK, 0, 0)
+	}
+	if bam.Avail(ts) {
+		bam.Alloc(ts)
+		return newDOSError(dosOK, 0, 0)
+	}
+	for next := ts; next.T <= totalTrackCount; next = (TS{next.T + 1, 0}) {
+		for ; next.S < sectorCount(next.T); next.S++ {
+			if bam.Avail(next) {
+				return newDOSError(dosNoBlock, next.T, next.S)
+			}
+		}
+	}
+	return newDOSError(dosNoBlock, 0, 0)
+}
+
+// blockIO handles U1 and U2 with the parameters channel, drive, track and
+// sector.
+func (dos *DOS) blockIO(arg string, write bool) *DOSError {
+	nums, ok := dosArgs(arg, 4)
+	if !ok {
+		return newDOSError(dosSyntaxError, 0, 0)
+	}
+	ts := TS{uint8(nums[2]), uint8(nums[3])}
+	if !ts.IsValid() {
+		return newDOSError(dosIllegalTS, ts.T, ts.S)
+	}
+	blk := (*[blockSize]byte)(dos.img.Block(ts))
+	buf := dos.Buffer(nums[0])
+	if write {
+		copy(blk[:], buf)
+	} else {
+		copy(buf, blk[:])
+	}
+	return newDOSError(dosOK, 0, 0)
+}
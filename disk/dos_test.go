@@ -0,0 +1,98 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"io/fs"
+	"testing"
+)
+
+func TestDOSCommands(t *testing.T) {
+	img := loadTestImage(t)
+	dos := NewDOS(img)
+	if reply := dos.Command("U1:2 0 18 0"); reply != "00, OK,00,00" {
+		t.Fatal(reply)
+	}
+	if !bytes.Equal(dos.Buffer(2), img[357*blockSize:358*blockSize]) {
+		t.Error("U1 read the wrong block")
+	}
+
+	for _, tc := range []struct{ cmd, reply string }{
+		{"I0", "00, OK,00,00"},
+		{"V0", "00, OK,00,00"},
+		{"X0", "31,SYNTAX ERROR,00,00"},
+		{"S0:NOPE", "01,FILES SCRATCHED,00,00"},
+		{"R0:DC64=NOPE", "63,FILE EXISTS,00,00"},
+		{"R0:NEW=NOPE", "62,FILE NOT FOUND,00,00"},
+		{"R0:NEW=DC64", "00, OK,00,00"},
+		{"S0:DB1*,DB6*", "01,FILES SCRATCHED,04,00"},
+		{"B-A 0 18 0", "65,NO BLOCK,18,03"},
+		{"B-A 0 36 0", "66,ILLEGAL TRACK OR SECTOR,36,00"},
+		{"U2:2 0 18 0", "00, OK,00,00"},
+		{"UJ", "73,CBM DOS V2.6 1541,00,00"},
+	} {
+		if reply := dos.Command(tc.cmd); reply != tc.reply {
+			t.Errorf("%s: got %q, expected %q", tc.cmd, reply, tc.reply)
+		}
+	}
+	if img.Lookup("NEW") == nil || img.Lookup("DB128") != nil || img.Lookup("DBP4") == nil {
+		t.Error("rename or scratch failed")
+	}
+	if reply := dos.Command("N0:EMPTY,AB"); reply != "00, OK,00,00" {
+		t.Fatal(reply)
+	}
+	if img.BAM().DiskID[0] != 'A' || len(img.Recoverable()) != 0 {
+		t.Error("format failed")
+	}
+}
+
+func TestDOSCopy(t *testing.T) {
+	var d Img
+	d.Init("COPY", "01")
+	d.WriteFile("ONE", SEQ, bytes.Repeat([]byte("1"), 300), nil)
+	d.WriteFile("TWO", PRG, bytes.Repeat([]byte("2"), 300), nil)
+	dos := NewDOS(&d)
+	for _, tc := range []struct{ cmd, reply string }{
+		{"C0:BOTH=ONE,0:TWO", "00, OK,00,00"},
+		{"C0:BOTH=ONE", "63,FILE EXISTS,00,00"},
+		{"C0:NONE=NOPE", "62,FILE NOT FOUND,00,00"},
+		{"C0:THREE=TWO", "00, OK,00,00"},
+		{"S0:ONE,0:THREE", "01,FILES SCRATCHED,02,00"},
+	} {
+		if reply := dos.Command(tc.cmd); reply != tc.reply {
+			t.Errorf("%s: got %q, expected %q", tc.cmd, reply, tc.reply)
+		}
+	}
+	both := d.Lookup("BOTH")
+	if both == nil || both.FileType != SEQ || both.BlockCount() != 3 {
+		t.Fatal("concatenated file is wrong")
+	}
+	if d.Lookup("ONE") != nil || d.Lookup("THREE") != nil {
+		t.Error("scratch with a drive number in the second pattern failed")
+	}
+	buf, _ := d.ReadFile(both)
+	if string(buf[299:301]) != "12" {
+		t.Error("concatenated contents are wrong")
+	}
+}
+
+func TestDOSErrors(t *testing.T) {
+	var d Img
+	d.Init("ERRORS", "01")
+	one, _ := d.WriteFile("ONE", SEQ, make([]byte, 300), nil)
+	two, _ := d.WriteFile("TWO", SEQ, make([]byte, 300), nil)
+	dos := NewDOS(&d)
+	two.FileTS = one.FileTS
+	if reply := dos.Command("V0"); reply != "71,DIR ERROR,00,00" {
+		t.Errorf("validate with a shared chain: %q", reply)
+	}
+	(*RawBlock)(d.Block(one.FileTS)).Link = TS{50, 0}
+	if reply := dos.Command("V0"); reply != "66,ILLEGAL TRACK OR SECTOR,00,00" {
+		t.Errorf("validate with a broken chain: %q", reply)
+	}
+	for _, err := range []error{BAMConflict, OutOfRange, BadIndex, ChainClash} {
+		if errors.Is(toDOSError(err), fs.ErrInvalid) {
+			t.Errorf("%v is reported as a syntax error", err)
+		}
+	}
+}
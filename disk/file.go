@@ -0,0 +1,340 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+var (
+	FileNotFound = errors.New("file not found")
+	FileExists = errors.New("file exists")
+	FileLocked = errors.New("file locked")
+)
+
+// WriteOptions changes how WriteFile stores a file on the disk.
+type WriteOptions struct {
+	// Force allows locked files to be modified.
+	Force bool
+	// Replace overwrites a file that already exists, like saving to "@0:NAME".
+	Replace bool
+	// ReplaceBug reproduces the save-with-replace bug of the 1541 when
+	// replacing a file: the BAM is written back from a copy taken before the
+	// new blocks were allocated, so they are left marked as free and later
+	// writes overwrite the file. Only useful for compatibility testing.
+	ReplaceBug bool
+	// Strategy chooses the blocks of the file. The default allocator is used
+	// when it is nil.
+	Strategy AllocStrategy
+}
+
+func (opts *WriteOptions) allocator(bam *BAM) *Allocator {
+	if opts.Strategy != nil {
+		return bam.NewStrategyAllocator(opts.Strategy)
+	}
+	return bam.NewAllocator()
+}
+
+// Lookup finds the directory entry of the file with the given name. Returns nil
+// if there is no such file.
+func (d *Img) Lookup(name string) *DirEntry {
+	if len(name) > len(DirEntry{}.Filename) {
+		return nil
+	}
+	padded := PadString(name, len(DirEntry{}.Filename))
+	for _, ent := range d.DirEntries() {
+		if !ent.IsScratched() && bytes.Equal(ent.Filename[:], padded) {
+			return ent
+		}
+	}
+	return nil
+}
+
+// ReadFile returns the contents of a file. The contents of a PRG file start
+// with its load address.
+func (d *Img) ReadFile(ent *DirEntry) ([]byte, error) {
+	chain, err := d.Chain(ent.FileTS)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for _, ts := range chain {
+		buf = append(buf, (*RawBlock)(d.Block(ts)).Bytes()...)
+	}
+	return buf, nil
+}
+
+// WriteFile stores data in newly allocated blocks and adds a directory entry
+// for it. The data of a PRG file must start with its load address. Returns
+// FileExists if a file already has the name and opts does not replace it, or
+// FileLocked if that file is locked and opts does not force it.
+func (d *Img) WriteFile(name string, typ FileType, data []byte, opts *WriteOptions) (*DirEntry, error) {
+	if opts == nil {
+		opts = &WriteOptions{}
+	}
+	if len(name) > len(DirEntry{}.Filename) {
+		return nil, errors.New("name overflow")
+	}
+	if ent := d.Lookup(name); ent != nil {
+		if ent.FileType.Locked() && !opts.Force {
+			return nil, FileLocked
+		}
+		if !opts.Replace {
+			return nil, FileExists
+		}
+		return d.replace(ent, typ, data, opts)
+	}
+
+	chain, err := d.writeChain(opts.allocator(d.BAM()), data)
+	if err != nil {
+		return nil, err
+	}
+	ent, err := d.NewDirEntry()
+	if err != nil {
+		d.freeChain(chain)
+		return nil, err
+	}
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: typ, FileTS: chain[0]}
+	ent.SetFilename(name)
+	ent.SetBlockCount(uint16(len(chain)))
+	return ent, nil
+}
+
+// replace writes the new contents of a file the way the DOS does: the first
+// block of the new chain is allocated and recorded in the SaveReplace field of
+// the entry, together with the replace flag, before any data is written. Only
+// once the new chain is complete is it swapped in, clearing both, and the old
+// chain freed. The old file is left untouched if the disk fills up.
+func (d *Img) replace(ent *DirEntry, typ FileType, data []byte, opts *WriteOptions) (*DirEntry, error) {
+	bam := d.BAM()
+	stale := *bam
+	old, err := d.Chain(ent.FileTS)
+	if err != nil {
+		return nil, err
+	}
+
+	a := opts.allocator(bam)
+	first, err := a.Alloc()
+	if err != nil {
+		return nil, err
+	}
+	ent.FileType |= FlagReplace
+	ent.SaveReplace = first
+	chain, err := d.writeChainAt(a, first, data)
+	if err != nil {
+		ent.FileType &^= FlagReplace
+		ent.SaveReplace = TS{}
+		return nil, err
+	}
+
+	// swap the chains
+	ent.FileTS, ent.SaveReplace = ent.SaveReplace, TS{}
+	ent.FileType = typ | ent.FileType & FlagLocked
+	ent.SetBlockCount(uint16(len(chain)))
+	if opts.ReplaceBug {
+		*bam = stale
+	}
+	d.freeChain(old)
+	return ent, nil
+}
+
+// writeChain copies data into a chain of blocks taken from the allocator. Every
+// block is freed again if the disk fills up.
+func (d *Img) writeChain(a *Allocator, data []byte) ([]TS, error) {
+	ts, err := a.Alloc()
+	if err != nil {
+		return nil, err
+	}
+	return d.writeChainAt(a, ts, data)
+}
+
+// writeChainAt is writeChain with the first block already allocated.
+func (d *Img) writeChainAt(a *Allocator, ts TS, data []byte) ([]TS, error) {
+	chain := []TS{ts}
+	for {
+		blk := (*RawBlock)(d.Block(ts))
+		if len(data) <= len(blk.Data) {
+			blk.Truncate(data)
+			return chain, nil
+		}
+		data = data[copy(blk.Data[:], data):]
+		var err error
+		if ts, err = a.Alloc(); err != nil {
+			d.freeChain(chain)
+			return nil, err
+		}
+		blk.Link = ts
+		chain = append(chain, ts)
+	}
+}
+
+// freeChain marks every block of a chain as available in the BAM.
+func (d *Img) freeChain(chain []TS) {
+	bam := d.BAM()
+	for _, ts := range chain {
+		bam.Free(ts)
+	}
+}
+
+// Remove scratches a file and frees its blocks. Locked files are only removed
+// when forced.
+func (d *Img) Remove(name string, force bool) error {
+	ent := d.Lookup(name)
+	if ent == nil {
+		return FileNotFound
+	}
+	if ent.FileType.Locked() && !force {
+		return FileLocked
+	}
+	d.scratch(ent)
+	return nil
+}
+
+func (d *Img) scratch(ent *DirEntry) {
+	// free what there is of a broken chain
+	blocks, _ := d.fileBlocks(ent)
+	d.freeChain(blocks)
+	ent.FileType = Scratched
+}
+
+// SetLocked sets or clears the lock flag of a file.
+func (d *Img) SetLocked(name string, locked bool) error {
+	ent := d.Lookup(name)
+	if ent == nil {
+		return FileNotFound
+	}
+	ent.FileType = ent.FileType.Set(FlagLocked, locked)
+	return nil
+}
+
+// Rename changes the name of a file. Returns FileExists if the new name is
+// already taken.
+func (d *Img) Rename(oldname, newname string) error {
+	if len(newname) > len(DirEntry{}.Filename) {
+		return errors.New("name overflow")
+	}
+	if d.Lookup(newname) != nil {
+		return FileExists
+	}
+	ent := d.Lookup(oldname)
+	if ent == nil {
+		return FileNotFound
+	}
+	ent.SetFilename(newname)
+	return nil
+}
+
+// Validate rebuilds the BAM from the directory and the chains of its files, the
+// way the DOS validate command does. The side sectors of REL files are kept,
+// and so are the info block and records of GEOS files, which the DOS would
+// free. Files that were never closed are scratched. The BAM is left unchanged
+// if a chain is broken or two chains share a block.
+func (d *Img) Validate() error {
+	bam := *d.BAM()
+	bam.FreeAll()
+	alloc := func(chain []TS) error {
+		for _, ts := range chain {
+			if err := bam.Alloc(ts); err != nil {
+				return fmt.Errorf("%v: %w", ts, err)
+			}
+		}
+		return nil
+	}
+	if err := alloc([]TS{{bamTrack, 0}}); err != nil {
+		return err
+	}
+	chain, err := d.Chain(bam.DirTS)
+	if err != nil {
+		return err
+	}
+	if err = alloc(chain); err != nil {
+		return err
+	}
+
+	var unclosed []*DirEntry
+	for _, ent := range d.DirEntries() {
+		switch {
+		case ent.IsScratched():
+			continue
+		case !ent.FileType.Closed():
+			unclosed = append(unclosed, ent)
+			continue
+		}
+		blocks, err := d.fileBlocks(ent)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ent.FilenameString(), err)
+		}
+		if err = alloc(blocks); err != nil {
+			return fmt.Errorf("%s: %w", ent.FilenameString(), err)
+		}
+	}
+	for _, ent := range unclosed {
+		ent.FileType = Scratched
+	}
+	*d.BAM() = bam
+	return nil
+}
+
+// geosVLIR reports whether a GEOS file is split into records, with FileTS
+// pointing to the index of their chains.
+func (fe *DirEntry) geosVLIR() bool {
+	return fe.GEOS() && fe.RelRecordSize == 1
+}
+
+// fileBlocks lists every block a file owns in the order they are laid out:
+// the info block of a GEOS file, the chain of the file, then the side sectors
+// of a REL file or the chains of the records of a VLIR file. When a chain is
+// broken, the blocks found up to the break are returned with the error.
+func (d *Img) fileBlocks(ent *DirEntry) ([]TS, error) {
+	if ent.FileType.Base() == DEL && ent.BlockCount() == 0 {
+		// separators in the directory do not own any blocks
+		return nil, nil
+	}
+	var blocks []TS
+	if ent.GEOS() {
+		blocks = append(blocks, ent.RelSideSector)
+	}
+	chain, err := d.Chain(ent.FileTS)
+	blocks = append(blocks, chain...)
+	if err != nil {
+		return blocks, err
+	}
+	switch {
+	case ent.FileType.Base() == REL:
+		side, err := d.Chain(ent.RelSideSector)
+		blocks = append(blocks, side...)
+		if err != nil {
+			return blocks, fmt.Errorf("side sectors: %w", err)
+		}
+	case ent.geosVLIR():
+		for i, rec := range d.vlirRecords(ent) {
+			if rec.IsNull() {
+				continue
+			}
+			chain, err := d.Chain(rec)
+			blocks = append(blocks, chain...)
+			if err != nil {
+				return blocks, fmt.Errorf("record %d: %w", i, err)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// vlirRecords lists the first block of each record of a VLIR file, in order,
+// from the index block. Empty records are listed as a null TS.
+func (d *Img) vlirRecords(ent *DirEntry) []TS {
+	index := blockBytes(d, ent.FileTS)
+	var recs []TS
+	for i := 2; i < blockSize; i += 2 {
+		rec := TS{index[i], index[i + 1]}
+		if rec.T == 0 {
+			if rec.S == 0 {
+				break
+			}
+			rec = TS{}
+		}
+		recs = append(recs, rec)
+	}
+	return recs
+}
@@ -0,0 +1,235 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+)
+
+// ImportOptions changes how ImportFS copies files onto a disk.
+type ImportOptions struct {
+	// Manifest is the path of a file in the file system which lists the files
+	// to import first, one path per line, in the order they get in the
+	// directory. Blank lines and lines starting with '#' are ignored. The
+	// other files follow, sorted by path.
+	Manifest string
+	// Strategy chooses the blocks of the files. The default allocator is used
+	// when it is nil.
+	Strategy AllocStrategy
+}
+
+// hostTypes maps the extensions of host files to file types.
+var hostTypes = map[string]FileType{
+	".prg": PRG,
+	".seq": SEQ,
+	".usr": USR,
+	".del": DEL,
+}
+
+// ImportFS copies every file of a file system onto the disk, walking into
+// directories. Host names become file names the way a user would type them:
+// the extension is removed, letters are uppercased, characters the DOS treats
+// specially become '-' and names are cut to 16 characters, with a "~2" suffix
+// and so on where two files would get the same name. The type comes from the
+// extension, which can be .prg, .seq, .usr, .del or a PC64 container like .p00,
+// and defaults to PRG. Hidden files are skipped.
+//
+// The disk is left unchanged if any file can not be imported, for example
+// because the disk is full.
+func ImportFS(d *Img, fsys fs.FS, opts *ImportOptions) ([]*DirEntry, error) {
+	if opts == nil {
+		opts = &ImportOptions{}
+	}
+	paths, err := importOrder(fsys, opts.Manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	orig := *d
+	var ents []*DirEntry
+	for _, p := range paths {
+		ent, err := importFile(d, fsys, p, opts)
+		if err != nil {
+			*d = orig
+			return nil, fmt.Errorf("%s: %w", p, err)
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// importOrder lists the files to import, those in the manifest first.
+func importOrder(fsys fs.FS, manifest string) ([]string, error) {
+	var all []string
+	err := fs.WalkDir(fsys, ".", func(p string, ent fs.DirEntry, err error) error {
+		switch {
+		case err != nil:
+			return err
+		case p != "." && strings.HasPrefix(ent.Name(), "."):
+			if ent.IsDir() {
+				return fs.SkipDir
+			}
+		case ent.Type().IsRegular() && p != manifest:
+			all = append(all, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(all)
+	if manifest == "" {
+		return all, nil
+	}
+
+	buf, err := fs.ReadFile(fsys, manifest)
+	if err != nil {
+		return nil, err
+	}
+	listed := make(map[string]bool)
+	var paths []string
+	sc := bufio.NewScanner(bytes.NewReader(buf))
+	for sc.Scan() {
+		p := strings.TrimSpace(sc.Text())
+		if p == "" || strings.HasPrefix(p, "#") {
+			continue
+		}
+		p = path.Clean(p)
+		if listed[p] {
+			return nil, fmt.Errorf("%s: %s listed twice", manifest, p)
+		}
+		if _, err := fs.Stat(fsys, p); err != nil {
+			return nil, fmt.Errorf("%s: %w", manifest, err)
+		}
+		listed[p] = true
+		paths = append(paths, p)
+	}
+	for _, p := range all {
+		if !listed[p] {
+			paths = append(paths, p)
+		}
+	}
+	return paths, nil
+}
+
+func importFile(d *Img, fsys fs.FS, p string, opts *ImportOptions) (*DirEntry, error) {
+	data, err := fs.ReadFile(fsys, p)
+	if err != nil {
+		return nil, err
+	}
+	name, typ, data, err := hostFile(p, data)
+	if err != nil {
+		return nil, err
+	}
+	name = uniqueName(d, name)
+
+	ent, err := d.WriteFile(string(name), typ, data, &WriteOptions{Strategy: opts.Strategy})
+	if err != nil {
+		return nil, err
+	}
+	return ent, nil
+}
+
+// hostFile gives the file name, type and contents of a host file from its path
+// and data, unpacking PC64 containers.
+func hostFile(p string, data []byte) ([]byte, FileType, []byte, error) {
+	base := path.Base(p)
+	ext := strings.ToLower(path.Ext(base))
+	stem := strings.TrimSuffix(base, path.Ext(base))
+
+	typ, ok := hostTypes[ext]
+	var name []byte
+	var err error
+	switch {
+	case ok:
+	case isP00(ext):
+		if typ, err = p00Type(ext); err != nil {
+			return nil, 0, nil, err
+		}
+		if name, data, err = readP00(data); err != nil {
+			return nil, 0, nil, err
+		}
+	default:
+		typ, stem = PRG, base
+	}
+	if name == nil {
+		name = HostName(stem)
+	}
+	return name, typ, data, nil
+}
+
+// HostName converts the name of a host file to a file name: letters are
+// uppercased, characters the DOS treats specially or that are not plain ASCII
+// become '-' and the name is cut to 16 characters.
+func HostName(s string) []byte {
+	var name []byte
+	for _, r := range strings.ToUpper(s) {
+		switch {
+		case len(name) == len(DirEntry{}.Filename):
+			return name
+		case r < 0x20 || r > 0x5D, strings.ContainsRune(",:=*?\"@$", r):
+			name = append(name, '-')
+		default:
+			name = append(name, byte(r))
+		}
+	}
+	if len(name) == 0 {
+		name = []byte("-")
+	}
+	return name
+}
+
+// uniqueName adds "~2", "~3" and so on to the end of a name, cutting it to
+// make room, until no file on the disk has it.
+func uniqueName(d *Img, name []byte) []byte {
+	unique := name
+	for n := 2; d.Lookup(string(unique)) != nil; n++ {
+		suffix := fmt.Sprintf("~%d", n)
+		stem := name
+		if max := len(DirEntry{}.Filename) - len(suffix); len(stem) > max {
+			stem = stem[:max]
+		}
+		unique = append(append([]byte(nil), stem...), suffix...)
+	}
+	return unique
+}
+
+// isP00 checks for the extensions of PC64 containers, like .p00 or .s12.
+func isP00(ext string) bool {
+	return len(ext) == 4 && strings.ContainsRune("dspur", rune(ext[1])) &&
+		ext[2] >= '0' && ext[2] <= '9' && ext[3] >= '0' && ext[3] <= '9'
+}
+
+func p00Type(ext string) (FileType, error) {
+	for i, s := range fileTypeNames {
+		if strings.ToLower(s)[0] == ext[1] {
+			if DEL+FileType(i) == REL {
+				return 0, fmt.Errorf("REL files can not be imported")
+			}
+			return DEL + FileType(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown PC64 type: %s", ext)
+}
+
+// readP00 splits a PC64 container into the name of the file it holds and its
+// contents.
+func readP00(buf []byte) ([]byte, []byte, error) {
+	const headerLen = len(p00Magic) + 16 + 2
+	if len(buf) < headerLen || !bytes.HasPrefix(buf, []byte(p00Magic)) {
+		return nil, nil, fmt.Errorf("not a PC64 file")
+	}
+	name := buf[len(p00Magic) : len(p00Magic)+16]
+	if i := bytes.IndexByte(name, 0); i >= 0 {
+		name = name[:i]
+	}
+	name = bytes.TrimRight(name, "\xa0")
+	if len(name) == 0 {
+		return nil, nil, fmt.Errorf("PC64 file without a name")
+	}
+	return append([]byte(nil), name...), buf[headerLen:], nil
+}
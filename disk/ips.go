@@ -0,0 +1,252 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+)
+
+const (
+	ipsMagic = "PATCH"
+	ipsEOF = "EOF"
+	bpsMagic = "BPS1"
+)
+
+// IsIPS checks for the header of an IPS patch.
+func IsIPS(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(ipsMagic))
+}
+
+// IsBPS checks for the header of a BPS patch.
+func IsBPS(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(bpsMagic))
+}
+
+// IPS encodes the patch in the IPS format, with a record for each run. IPS has
+// no checksums, so the result applies to any image without checking it.
+func (p *Patch) IPS() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(ipsMagic)
+	for _, blk := range p.Blocks {
+		base, _ := blk.TS.Offset()
+		for _, run := range blk.Runs {
+			off := base + uint32(run.Off)
+			buf.Write([]byte{byte(off >> 16), byte(off >> 8), byte(off)})
+			binary.Write(&buf, binary.BigEndian, uint16(len(run.Data)))
+			buf.Write(run.Data)
+		}
+	}
+	buf.WriteString(ipsEOF)
+	return buf.Bytes()
+}
+
+// ParseIPS reads an IPS patch meant for the disk base. IPS has no checksums,
+// so those of the patch are taken from base and Apply never refuses it.
+func ParseIPS(buf []byte, base *Img) (*Patch, error) {
+	if !IsIPS(buf) {
+		return nil, fmt.Errorf("%w: not an IPS patch", BadPatch)
+	}
+	target := *base
+	r := bytes.NewReader(buf[len(ipsMagic):])
+	for {
+		var rec [5]byte
+		if n, _ := r.Read(rec[:3]); n != 3 {
+			return nil, fmt.Errorf("%w: IPS patch without EOF", BadPatch)
+		}
+		if string(rec[:3]) == ipsEOF {
+			break
+		}
+		if n, _ := r.Read(rec[3:]); n != 2 {
+			return nil, fmt.Errorf("%w: truncated IPS record", BadPatch)
+		}
+		off := int(rec[0]) << 16 | int(rec[1]) << 8 | int(rec[2])
+		size := int(binary.BigEndian.Uint16(rec[3:]))
+		var data []byte
+		if size == 0 {
+			// run length encoded
+			var rle [3]byte
+			if n, _ := r.Read(rle[:]); n != 3 {
+				return nil, fmt.Errorf("%w: truncated IPS record", BadPatch)
+			}
+			size = int(binary.BigEndian.Uint16(rle[:]))
+			data = bytes.Repeat(rle[2:], size)
+		} else {
+			data = make([]byte, size)
+			if n, _ := r.Read(data); n != size {
+				return nil, fmt.Errorf("%w: truncated IPS record", BadPatch)
+			}
+		}
+		if off + size > len(target) {
+			return nil, fmt.Errorf("%w: IPS record at $%06X is past the end of the image", BadPatch, off)
+		}
+		copy(target[off:], data)
+	}
+	// an optional truncation size may follow
+	if r.Len() == 3 {
+		var size [3]byte
+		r.Read(size[:])
+		if n := int(size[0]) << 16 | int(size[1]) << 8 | int(size[2]); n != len(target) {
+			return nil, fmt.Errorf("%w: IPS patch resizes the image to %d bytes", BadPatch, n)
+		}
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data after IPS EOF", BadPatch)
+	}
+	return MakePatch(base, &target), nil
+}
+
+// BPS encodes the patch in the BPS format. BPS checks the CRC-32 of the whole
+// image, so the disk the patch was made from is needed.
+func (p *Patch) BPS(base *Img) ([]byte, error) {
+	target := *base
+	if err := p.Apply(&target); err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(bpsMagic)
+	bpsWriteNum(&buf, uint64(len(base)))
+	bpsWriteNum(&buf, uint64(len(target)))
+	bpsWriteNum(&buf, 0)
+	for i := 0; i < len(target); {
+		j := i
+		same := base[i] == target[i]
+		for j < len(target) && (base[j] == target[j]) == same {
+			j++
+		}
+		if same {
+			// SourceRead
+			bpsWriteNum(&buf, uint64(j - i - 1) << 2 | 0)
+		} else {
+			// TargetRead
+			bpsWriteNum(&buf, uint64(j - i - 1) << 2 | 1)
+			buf.Write(target[i:j])
+		}
+		i = j
+	}
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(base[:]))
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(target[:]))
+	binary.Write(&buf, binary.LittleEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes(), nil
+}
+
+// ParseBPS reads a BPS patch meant for the disk base. The CRC-32 of base must
+// match the one in the patch.
+func ParseBPS(buf []byte, base *Img) (*Patch, error) {
+	if !IsBPS(buf) || len(buf) < len(bpsMagic) + 12 {
+		return nil, fmt.Errorf("%w: not a BPS patch", BadPatch)
+	}
+	end := len(buf) - 12
+	sums := buf[end:]
+	if crc32.ChecksumIEEE(buf[:len(buf) - 4]) != binary.LittleEndian.Uint32(sums[8:]) {
+		return nil, fmt.Errorf("%w: bad BPS checksum", BadPatch)
+	}
+	if crc32.ChecksumIEEE(base[:]) != binary.LittleEndian.Uint32(sums) {
+		return nil, fmt.Errorf("%w: the BPS source checksum differs", PatchMismatch)
+	}
+
+	r := &bpsReader{buf: buf[:end], pos: len(bpsMagic)}
+	srcSize, tgtSize, metaSize := r.num(), r.num(), r.num()
+	if srcSize != uint64(len(base)) || tgtSize != uint64(len(base)) {
+		return nil, fmt.Errorf("%w: BPS patch for %d bytes to %d bytes, not a d64", BadPatch, srcSize, tgtSize)
+	}
+	if metaSize > uint64(len(r.buf) - r.pos) {
+		return nil, fmt.Errorf("%w: truncated BPS patch", BadPatch)
+	}
+	r.pos += int(metaSize)
+
+	var target Img
+	var out, srcRel, tgtRel int
+	for r.err == nil && r.pos < len(r.buf) {
+		data := r.num()
+		cmd, n := data & 3, int(data >> 2) + 1
+		if data >> 2 >= uint64(len(target)) || out + n > len(target) {
+			return nil, fmt.Errorf("%w: BPS action writes past the end of the image", BadPatch)
+		}
+		switch cmd {
+		case 0:
+			copy(target[out:out + n], base[out:])
+		case 1:
+			if r.pos + n > len(r.buf) {
+				return nil, fmt.Errorf("%w: truncated BPS patch", BadPatch)
+			}
+			copy(target[out:], r.buf[r.pos:r.pos + n])
+			r.pos += n
+		case 2:
+			srcRel += r.offset()
+			if srcRel < 0 || srcRel > len(base) || srcRel + n > len(base) {
+				return nil, fmt.Errorf("%w: BPS source copy out of range", BadPatch)
+			}
+			copy(target[out:out + n], base[srcRel:])
+			srcRel += n
+		case 3:
+			tgtRel += r.offset()
+			if tgtRel < 0 || tgtRel >= out || tgtRel + n > len(target) {
+				return nil, fmt.Errorf("%w: BPS target copy out of range", BadPatch)
+			}
+			// the copy may overlap what it writes
+			for i := 0; i < n; i++ {
+				target[out + i] = target[tgtRel]
+				tgtRel++
+			}
+		}
+		out += n
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("%w: %v", BadPatch, r.err)
+	}
+	if out != len(target) {
+		return nil, fmt.Errorf("%w: BPS patch stops at %d bytes", BadPatch, out)
+	}
+	if crc32.ChecksumIEEE(target[:]) != binary.LittleEndian.Uint32(sums[4:]) {
+		return nil, fmt.Errorf("%w: bad BPS target checksum", BadPatch)
+	}
+	return MakePatch(base, &target), nil
+}
+
+func bpsWriteNum(buf *bytes.Buffer, n uint64) {
+	for {
+		x := byte(n & 0x7F)
+		n >>= 7
+		if n == 0 {
+			buf.WriteByte(0x80 | x)
+			return
+		}
+		buf.WriteByte(x)
+		n--
+	}
+}
+
+type bpsReader struct {
+	buf []byte
+	pos int
+	err error
+}
+
+func (r *bpsReader) num() uint64 {
+	var n uint64
+	shift := uint64(1)
+	for {
+		if r.pos >= len(r.buf) || shift > 1 << 56 {
+			r.err = fmt.Errorf("bad BPS number at %d", r.pos)
+			return 0
+		}
+		x := r.buf[r.pos]
+		r.pos++
+		n += uint64(x & 0x7F) * shift
+		if x & 0x80 != 0 {
+			return n
+		}
+		shift <<= 7
+		n += shift
+	}
+}
+
+// offset reads the signed relative offset of a copy action.
+func (r *bpsReader) offset() int {
+	n := r.num()
+	if n & 1 != 0 {
+		return -int(n >> 1)
+	}
+	return int(n >> 1)
+}
@@ -0,0 +1,118 @@
+package disk
+
+import (
+	"bytes"
+	"strconv"
+)
+
+const (
+	// listingLoadAddr is where the listing loads, the start of BASIC on a
+	// PET. The C64 relinks the lines when it loads.
+	listingLoadAddr = 0x0401
+	// listingLink is the dummy link the drive puts at the start of each line.
+	listingLink = 0x0101
+	// listingLineLen is the length of the text of an entry line.
+	listingLineLen = 27
+	rvsOn = 0x12
+)
+
+// listingLine is a line of the directory listing: the line number and the text
+// after it.
+type listingLine struct {
+	num uint16
+	text []byte
+}
+
+// listingLines builds the lines of the listing the way the 1541 does.
+func (d *Img) listingLines() []listingLine {
+	bam := d.BAM()
+	var lines []listingLine
+
+	// 0 "DISK NAME       " ID 2A
+	header := []byte{rvsOn, '"'}
+	header = append(header, bam.DiskName[:]...)
+	header = append(header, '"', ' ')
+	header = append(header, bam.DiskID[:]...)
+	header = append(header, bam.DOSVersion[:2]...)
+	unpadListing(header[2:])
+	lines = append(lines, listingLine{0, header})
+
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		blocks := ent.BlockCount()
+		var text []byte
+		for n := uint16(1000); n > 1 && blocks < n; n /= 10 {
+			text = append(text, ' ')
+		}
+
+		// The name is closed by a quote in place of the first shifted space,
+		// so any bytes after it follow the quote.
+		name := append([]byte(nil), ent.Filename[:]...)
+		end := nameLen(name)
+		unpadListing(name)
+		text = append(text, '"')
+		text = append(text, name...)
+		text = append(text, ' ')
+		text[len(text)-len(name)-1+end] = '"'
+
+		splat := byte(' ')
+		if !ent.FileType.Closed() {
+			splat = '*'
+		}
+		lock := byte(' ')
+		if ent.FileType.Locked() {
+			lock = '<'
+		}
+		text = append(text, splat)
+		text = append(text, ent.FileType.Base().String()...)
+		text = append(text, lock)
+		for len(text) < listingLineLen {
+			text = append(text, ' ')
+		}
+		lines = append(lines, listingLine{blocks, text})
+	}
+
+	free := append([]byte("BLOCKS FREE."), bytes.Repeat([]byte{' '}, 13)...)
+	lines = append(lines, listingLine{bam.BlocksFree(), free})
+	return lines
+}
+
+// unpadListing turns shifted spaces into plain ones.
+func unpadListing(buf []byte) {
+	for i, c := range buf {
+		if c == padByte {
+			buf[i] = ' '
+		}
+	}
+}
+
+// Listing returns the directory as the drive sends it for LOAD"$",8: a BASIC
+// program, starting with its load address, that lists the disk name and ID,
+// one line per file with its size in blocks, name and type, and the number of
+// blocks free.
+func (d *Img) Listing() []byte {
+	prg := []byte{listingLoadAddr & 0xFF, listingLoadAddr >> 8}
+	for _, line := range d.listingLines() {
+		prg = append(prg, listingLink & 0xFF, listingLink >> 8)
+		prg = append(prg, byte(line.num), byte(line.num >> 8))
+		prg = append(prg, line.text...)
+		prg = append(prg, 0)
+	}
+	// a null link ends the program
+	return append(prg, 0, 0)
+}
+
+// ListingText returns the directory as PETSCII text, the way LIST prints it
+// after the listing has been loaded. Each line ends with a carriage return.
+func (d *Img) ListingText() []byte {
+	var text []byte
+	for _, line := range d.listingLines() {
+		text = strconv.AppendUint(text, uint64(line.num), 10)
+		text = append(text, ' ')
+		text = append(text, line.text...)
+		text = append(text, '\r')
+	}
+	return text
+}
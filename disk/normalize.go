@@ -0,0 +1,158 @@
+package disk
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+// Normalize clears the bytes of the image that the DOS does not read, so that
+// two disks holding the same files in the same blocks are equal byte for byte:
+//
+//   - blocks the BAM marks as free and no chain holds are zeroed
+//   - the bytes after the end of the last block of each file, and of each
+//     record of a GEOS VLIR file, are zeroed
+//   - scratched directory entries are zeroed, as are the link bytes of all
+//     but the first entry of each directory block and the save-with-replace
+//     link of files not being replaced, which GEOS files use for their date
+//   - the padding of the BAM is set to what the 1541 formats a disk with, and
+//     the bits and free counts of sectors a track does not have are cleared
+//
+// Blocks in use are never changed, even when the BAM and the chains disagree,
+// so the side sectors of REL files and the blocks of GEOS files are kept.
+// Scratched files can not be undeleted afterwards.
+func (d *Img) Normalize() {
+	for _, track := range d.BlockMap() {
+		for _, u := range track {
+			if u.Free && !u.Used() {
+				blk := (*[blockSize]byte)(d.Block(u.TS))
+				*blk = [blockSize]byte{}
+			}
+		}
+	}
+
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() || ent.FileType.Base() == REL {
+			continue
+		}
+		// the records of a VLIR file end like files of their own
+		starts := []TS{ent.FileTS}
+		if ent.geosVLIR() {
+			starts = d.vlirRecords(ent)
+		}
+		for _, ts := range starts {
+			chain, err := d.Chain(ts)
+			if err != nil || len(chain) == 0 {
+				continue
+			}
+			last := (*RawBlock)(d.Block(chain[len(chain) - 1]))
+			if last.EOF() {
+				tail := last.Data[last.Len():]
+				for i := range tail {
+					tail[i] = 0
+				}
+			}
+		}
+	}
+
+	bam := d.BAM()
+	dirs, _ := d.Chain(bam.DirTS)
+	for _, ts := range dirs {
+		dir := (*DirBlock)(d.Block(ts))
+		for i := range dir.Files {
+			ent := &dir.Files[i]
+			link := ent.DirLink
+			switch {
+			case ent.IsScratched():
+				*ent = DirEntry{}
+			case ent.FileType & FlagReplace == 0 && !ent.GEOS():
+				ent.SaveReplace = TS{}
+			}
+			if i == 0 {
+				ent.DirLink = link
+			} else {
+				ent.DirLink = TS{}
+			}
+		}
+	}
+
+	bam.Unused1 = 0
+	bam.DiskID[2] = padByte
+	for i := 2; i < len(bam.DOSVersion); i++ {
+		bam.DOSVersion[i] = padByte
+	}
+	bam.Unused2 = [len(BAM{}.Unused2)]byte{}
+	for i := range bam.AvailMap {
+		ent := &bam.AvailMap[i]
+		n := sectorCount(uint8(i + 1))
+		ent.Count = 0
+		for s := uint8(0); s < uint8(8 * len(ent.free)); s++ {
+			bit := byte(1 << (s % 8))
+			switch {
+			case s >= n:
+				ent.free[s / 8] &^= bit
+			case ent.free[s / 8] & bit > 0:
+				ent.Count++
+			}
+		}
+	}
+}
+
+// ContentHash returns a SHA-256 digest of what the disk holds as seen through
+// the DOS: the disk name and ID, then the name, type, flags and contents of
+// every file in directory order. The info block of a GEOS file is part of its
+// contents, and so is each record of a VLIR file in place of the index.
+// Disks that only differ in free blocks, in the placement of their files or in
+// bytes Normalize clears have the same hash.
+func (d *Img) ContentHash() ([sha256.Size]byte, error) {
+	var sum [sha256.Size]byte
+	h := sha256.New()
+	bam := d.BAM()
+	h.Write(bam.DiskName[:])
+	h.Write(bam.DiskID[:2])
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		h.Write([]byte{byte(ent.FileType &^ FlagReplace)})
+		h.Write(ent.Filename[:])
+		h.Write([]byte{ent.RelRecordSize})
+		if err := d.hashFile(h, ent); err != nil {
+			return sum, fmt.Errorf("%q: %w", ent.FilenameString(), err)
+		}
+	}
+	copy(sum[:], h.Sum(nil))
+	return sum, nil
+}
+
+// hashFile writes the contents of a file to h, each part preceded by its
+// length. Empty records of a VLIR file are written as a length of all ones.
+func (d *Img) hashFile(h io.Writer, ent *DirEntry) error {
+	write := func(ts TS) error {
+		data, err := d.ReadFile(&DirEntry{FileTS: ts})
+		if err != nil {
+			return err
+		}
+		binary.Write(h, binary.BigEndian, uint64(len(data)))
+		h.Write(data)
+		return nil
+	}
+	if !ent.GEOS() {
+		return write(ent.FileTS)
+	}
+	h.Write(blockBytes(d, ent.RelSideSector)[2:])
+	if !ent.geosVLIR() {
+		return write(ent.FileTS)
+	}
+	for i, rec := range d.vlirRecords(ent) {
+		if rec.IsNull() {
+			binary.Write(h, binary.BigEndian, ^uint64(0))
+			continue
+		}
+		if err := write(rec); err != nil {
+			return fmt.Errorf("record %d: %w", i, err)
+		}
+	}
+	return nil
+}
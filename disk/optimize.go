@@ -0,0 +1,78 @@
+package disk
+
+import (
+	"fmt"
+)
+
+// Optimize rewrites the disk so that every file is stored in fresh blocks laid
+// out by the allocation strategy, such as a Profile. The files are copied the
+// way CopyFile copies them, so the side sectors of REL files and the info
+// blocks and records of GEOS files are kept. The directory is compacted to drop
+// scratched entries and any directory blocks they leave empty, and the BAM is
+// rebuilt. The files keep their order, entries and contents.
+//
+// The disk is left unchanged if a chain is broken, if the files do not fit, or
+// if the BAM allocates blocks that no file holds, such as blocks reserved with
+// B-A or the sectors of a boot loader, which would be lost.
+func (d *Img) Optimize(profile AllocStrategy) error {
+	type file struct {
+		ent *DirEntry
+		blocks []TS
+	}
+	var files []file
+	bam := d.BAM()
+	owned := map[TS]bool{{bamTrack, 0}: true}
+	dir, err := d.Chain(bam.DirTS)
+	if err != nil {
+		return fmt.Errorf("directory: %w", err)
+	}
+	for _, ts := range dir {
+		owned[ts] = true
+	}
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		// DEL entries used as separators in the listing own no blocks
+		blocks, err := d.fileBlocks(ent)
+		if err != nil {
+			return fmt.Errorf("%s: %w", ent.FilenameString(), err)
+		}
+		for _, ts := range blocks {
+			owned[ts] = true
+		}
+		files = append(files, file{ent, blocks})
+	}
+	for t := uint8(1); t <= totalTrackCount; t++ {
+		for s := uint8(0); s < sectorCount(t); s++ {
+			if ts := (TS{t, s}); !bam.Avail(ts) && !owned[ts] {
+				return fmt.Errorf("block %d/%d is allocated but no file holds it", t, s)
+			}
+		}
+	}
+
+	// keep the name, ID and the rest of the BAM block
+	var out Img
+	obam := out.BAM()
+	*obam = *bam
+	obam.FreeAll()
+	obam.DirTS = TS{bamTrack, 1}
+	obam.Alloc(TS{bamTrack, 0})
+	obam.Alloc(obam.DirTS)
+	out.Dir().Init()
+
+	opts := &CopyOptions{Strategy: profile}
+	for _, f := range files {
+		moved, err := copyBlocks(&out, d, f.ent, f.blocks, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %w", f.ent.FilenameString(), err)
+		}
+		ent, err := out.NewDirEntry()
+		if err != nil {
+			return err
+		}
+		ent.relink(f.ent, moved)
+	}
+	*d = out
+	return nil
+}
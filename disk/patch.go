@@ -0,0 +1,174 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+var (
+	PatchMismatch = errors.New("patch does not match the image")
+	BadPatch = errors.New("malformed patch")
+)
+
+const patchMagic = "D64PATCH\x01"
+
+// Patch holds the changes between two disks, block by block. Each block
+// carries the CRC-32 of its contents before and after the change, so a patch
+// is only applied to the disk it was made from.
+type Patch struct {
+	Blocks []PatchBlock
+}
+
+// PatchBlock is the change of one block.
+type PatchBlock struct {
+	TS TS
+	// Old and New are the CRC-32 of the block before and after the change.
+	Old uint32
+	New uint32
+	Runs []PatchRun
+}
+
+// PatchRun replaces the bytes of a block starting at Off with Data.
+type PatchRun struct {
+	Off uint8
+	Data []byte
+}
+
+func blockBytes(d *Img, ts TS) *[blockSize]byte {
+	return (*[blockSize]byte)(d.Block(ts))
+}
+
+// MakePatch returns the patch which turns disk from into disk to.
+func MakePatch(from, to *Img) *Patch {
+	p := &Patch{}
+	for t := uint8(1); t <= totalTrackCount; t++ {
+		for s := uint8(0); s < sectorCount(t); s++ {
+			ts := TS{t, s}
+			a, b := blockBytes(from, ts), blockBytes(to, ts)
+			if *a == *b {
+				continue
+			}
+			blk := PatchBlock{TS: ts, Old: crc32.ChecksumIEEE(a[:]), New: crc32.ChecksumIEEE(b[:])}
+			for i := 0; i < blockSize; {
+				if a[i] == b[i] {
+					i++
+					continue
+				}
+				j := i
+				for j < blockSize && a[j] != b[j] {
+					j++
+				}
+				blk.Runs = append(blk.Runs, PatchRun{uint8(i), append([]byte(nil), b[i:j]...)})
+				i = j
+			}
+			p.Blocks = append(p.Blocks, blk)
+		}
+	}
+	return p
+}
+
+// Apply changes the blocks of the disk. Nothing is changed unless the CRC-32 of
+// every block matches the one the patch was made from; the error is then
+// PatchMismatch naming the first block that differs.
+func (p *Patch) Apply(d *Img) error {
+	for _, blk := range p.Blocks {
+		sum := crc32.ChecksumIEEE(blockBytes(d, blk.TS)[:])
+		switch {
+		case sum == blk.Old:
+		case sum == blk.New:
+			return fmt.Errorf("block %d/%d: %w: already patched", blk.TS.T, blk.TS.S, PatchMismatch)
+		default:
+			return fmt.Errorf("block %d/%d: %w", blk.TS.T, blk.TS.S, PatchMismatch)
+		}
+	}
+	for _, blk := range p.Blocks {
+		buf := blockBytes(d, blk.TS)
+		for _, run := range blk.Runs {
+			copy(buf[run.Off:], run.Data)
+		}
+	}
+	return nil
+}
+
+// Bytes encodes the patch. The encoding starts with "D64PATCH" and a version
+// byte, then the number of blocks. Each block is its track, sector, old and new
+// CRC-32 and the number of runs, followed by the runs as an offset, the length
+// minus one and the data. A CRC-32 of all of it comes last. Numbers are big
+// endian.
+func (p *Patch) Bytes() []byte {
+	var buf bytes.Buffer
+	buf.WriteString(patchMagic)
+	binary.Write(&buf, binary.BigEndian, uint16(len(p.Blocks)))
+	for _, blk := range p.Blocks {
+		buf.Write([]byte{blk.TS.T, blk.TS.S})
+		binary.Write(&buf, binary.BigEndian, blk.Old)
+		binary.Write(&buf, binary.BigEndian, blk.New)
+		buf.WriteByte(uint8(len(blk.Runs)))
+		for _, run := range blk.Runs {
+			buf.Write([]byte{run.Off, uint8(len(run.Data) - 1)})
+			buf.Write(run.Data)
+		}
+	}
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+// IsPatch checks for the encoding of Bytes.
+func IsPatch(buf []byte) bool {
+	return bytes.HasPrefix(buf, []byte(patchMagic[:len(patchMagic) - 1]))
+}
+
+// ParsePatch decodes a patch encoded by Bytes.
+func ParsePatch(buf []byte) (*Patch, error) {
+	if !IsPatch(buf) || len(buf) < len(patchMagic) + 6 {
+		return nil, fmt.Errorf("%w: not a d64 patch", BadPatch)
+	}
+	if buf[len(patchMagic) - 1] != patchMagic[len(patchMagic) - 1] {
+		return nil, fmt.Errorf("%w: unknown version %d", BadPatch, buf[len(patchMagic) - 1])
+	}
+	body := buf[:len(buf) - 4]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(buf[len(body):]) {
+		return nil, fmt.Errorf("%w: bad checksum", BadPatch)
+	}
+	r := bytes.NewReader(body[len(patchMagic):])
+	var n uint16
+	binary.Read(r, binary.BigEndian, &n)
+	p := &Patch{}
+	seen := make(map[TS]bool)
+	for i := 0; i < int(n); i++ {
+		var hdr struct {
+			TS TS
+			Old, New uint32
+			Runs uint8
+		}
+		if err := binary.Read(r, binary.BigEndian, &hdr); err != nil {
+			return nil, fmt.Errorf("%w: truncated", BadPatch)
+		}
+		if !hdr.TS.IsValid() || seen[hdr.TS] {
+			return nil, fmt.Errorf("%w: bad block %d/%d", BadPatch, hdr.TS.T, hdr.TS.S)
+		}
+		seen[hdr.TS] = true
+		blk := PatchBlock{TS: hdr.TS, Old: hdr.Old, New: hdr.New}
+		for j := 0; j < int(hdr.Runs); j++ {
+			var run [2]byte
+			if _, err := r.Read(run[:]); err != nil {
+				return nil, fmt.Errorf("%w: truncated", BadPatch)
+			}
+			off, size := int(run[0]), int(run[1]) + 1
+			if off + size > blockSize || r.Len() < size {
+				return nil, fmt.Errorf("%w: bad run in block %d/%d", BadPatch, hdr.TS.T, hdr.TS.S)
+			}
+			data := make([]byte, size)
+			r.Read(data)
+			blk.Runs = append(blk.Runs, PatchRun{uint8(off), data})
+		}
+		p.Blocks = append(p.Blocks, blk)
+	}
+	if r.Len() != 0 {
+		return nil, fmt.Errorf("%w: trailing data", BadPatch)
+	}
+	return p, nil
+}
@@ -0,0 +1,155 @@
+package disk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// MatchName compares a filename pattern with the padded filename of a directory
+// entry the same way the 1541 does. A '?' matches any single character and a
+// '*' matches the rest of the name, including nothing. Any characters in the
+// pattern after the '*' are ignored. Otherwise the pattern must be exactly as
+// long as the name.
+func MatchName(pattern []byte, name [16]byte) bool {
+	n := nameLen(name[:])
+	for i, c := range pattern {
+		switch {
+		case c == '*':
+			return true
+		case i >= n:
+			return false
+		case c != '?' && c != name[i]:
+			return false
+		}
+	}
+	return len(pattern) == n
+}
+
+// nameLen is the length of a filename without its padding.
+func nameLen(name []byte) int {
+	for i, c := range name {
+		if c == padByte {
+			return i
+		}
+	}
+	return len(name)
+}
+
+// OpenSpec is a parsed CBM open string such as `@0:FILE,S,W` or `"FILE",P,R`.
+type OpenSpec struct {
+	// Drive is -1 when no drive number was given.
+	Drive int
+	// Replace is set by a leading '@'.
+	Replace bool
+	// Pattern is the filename, which may hold wildcards.
+	Pattern string
+	// Type is 0 when no file type was given.
+	Type FileType
+	// Mode is 'R', 'W', 'A' or 'M', or 0 when no mode was given.
+	Mode byte
+	// RecordLen is the record length of a REL file opened with ",L,".
+	RecordLen byte
+}
+
+// ParseOpen splits a CBM open string into its drive, replace flag, pattern,
+// type and mode. Quotes are removed from the name, so the string can be copied
+// from a BASIC OPEN or LOAD statement.
+func ParseOpen(s string) (OpenSpec, error) {
+	spec := OpenSpec{Drive: -1}
+	s = strings.TrimSpace(s)
+	if strings.HasPrefix(s, "\"") {
+		// "FILE",P,R
+		end := strings.IndexByte(s[1:], '"')
+		if end < 0 {
+			return spec, fmt.Errorf("%s: missing closing quote", s)
+		}
+		s = s[1:end+1] + s[end+2:]
+	}
+
+	name, params := s, ""
+	if i := strings.IndexByte(s, ','); i >= 0 {
+		name, params = s[:i], s[i+1:]
+	}
+	if strings.HasPrefix(name, "@") {
+		spec.Replace = true
+		name = name[1:]
+	}
+	if i := strings.IndexByte(name, ':'); i >= 0 {
+		if i > 0 {
+			drive, err := strconv.Atoi(name[:i])
+			if err != nil {
+				return spec, fmt.Errorf("%s: bad drive number", s)
+			}
+			spec.Drive = drive
+		}
+		name = name[i+1:]
+	}
+	if name == "" {
+		return spec, fmt.Errorf("%s: missing filename", s)
+	}
+	if len(name) > len(DirEntry{}.Filename) {
+		return spec, fmt.Errorf("%s: filename longer than 16 characters", s)
+	}
+	spec.Pattern = name
+	if params == "" {
+		return spec, nil
+	}
+
+	// Only the first letter of each parameter matters, so ",PRG,READ" is the
+	// same as ",P,R".
+	fields := strings.Split(params, ",")
+	for i := 0; i < len(fields); i++ {
+		f := strings.TrimSpace(fields[i])
+		if f == "" {
+			return spec, fmt.Errorf("%s: empty parameter", s)
+		}
+		switch f[0] {
+		case 'P':
+			spec.Type = PRG
+		case 'S':
+			spec.Type = SEQ
+		case 'U':
+			spec.Type = USR
+		case 'L':
+			spec.Type = REL
+			if i+1 < len(fields) && len(fields[i+1]) == 1 {
+				i++
+				spec.RecordLen = fields[i][0]
+			}
+		case 'R', 'W', 'A', 'M':
+			spec.Mode = f[0]
+		default:
+			return spec, fmt.Errorf("%s: unknown parameter %q", s, f)
+		}
+	}
+	return spec, nil
+}
+
+// Match reports whether a directory entry matches the pattern and, if one was
+// given, the type of the open string.
+func (spec *OpenSpec) Match(ent *DirEntry) bool {
+	if ent.IsScratched() {
+		return false
+	}
+	if spec.Type != 0 && ent.FileType.Base() != spec.Type {
+		return false
+	}
+	return MatchName([]byte(spec.Pattern), ent.Filename)
+}
+
+// Glob returns the directory entries of the files matching a CBM pattern such
+// as `0:DEMO*` or `"GAME?",P`, in directory order.
+func (d *Img) Glob(pattern string) ([]*DirEntry, error) {
+	spec, err := ParseOpen(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var matches []*DirEntry
+	for _, ent := range d.DirEntries() {
+		if spec.Match(ent) {
+			matches = append(matches, ent)
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,76 @@
+package disk
+
+import (
+	"io/fs"
+	"reflect"
+	"testing"
+)
+
+func TestMatchName(t *testing.T) {
+	var name [16]byte
+	copy(name[:], PadString("GAME", 16))
+	for pattern, want := range map[string]bool{
+		"GAME": true,
+		"GA*": true,
+		"*": true,
+		"G?ME": true,
+		"GAM": false,
+		"GAMES": false,
+		"GAME?": false,
+		"GAME*": true,
+		"G*X": true,
+	} {
+		if MatchName([]byte(pattern), name) != want {
+			t.Errorf("%s: expected %v", pattern, want)
+		}
+	}
+}
+
+func TestParseOpen(t *testing.T) {
+	for s, want := range map[string]OpenSpec{
+		"GAME*": {Drive: -1, Pattern: "GAME*"},
+		"0:GAME*": {Drive: 0, Pattern: "GAME*"},
+		"@0:FILE,S,W": {Drive: 0, Replace: true, Pattern: "FILE", Type: SEQ, Mode: 'W'},
+		`"FILE",P,R`: {Drive: -1, Pattern: "FILE", Type: PRG, Mode: 'R'},
+		"DATA,L,\x40": {Drive: -1, Pattern: "DATA", Type: REL, RecordLen: 0x40},
+		"@:LOG,SEQ,APPEND": {Drive: -1, Replace: true, Pattern: "LOG", Type: SEQ, Mode: 'A'},
+	} {
+		spec, err := ParseOpen(s)
+		if err != nil {
+			t.Errorf("%s: %v", s, err)
+		} else if spec != want {
+			t.Errorf("%s: got %+v", s, spec)
+		}
+	}
+	for _, s := range []string{"", "0:", `"FILE`, "X:FILE", "FILE,Q", "SEVENTEENCHARSXXX"} {
+		if _, err := ParseOpen(s); err == nil {
+			t.Errorf("%q: expected an error", s)
+		}
+	}
+}
+
+func TestGlob(t *testing.T) {
+	img := loadTestImage(t)
+	want := []string{"DracCopy 1.0/DB128.PRG", "DracCopy 1.0/DB1280.PRG"}
+	for _, tc := range []struct {
+		fsys fs.FS
+		pattern string
+		want []string
+	}{
+		{img.FS(), "DracCopy 1.0/DB[1-9]28*", want},
+		{img.FS(), "DracCopy 1.0/DB?28*,P", nil},
+		{img.FS(CBMGlob()), "DracCopy 1.0/DB?28*,P", want},
+		{img.FS(CBMGlob()), "DracCopy 1.0/DB?28*,S", nil},
+	} {
+		names, err := fs.Glob(tc.fsys, tc.pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(names, tc.want) {
+			t.Errorf("%s: wrong matches: %v", tc.pattern, names)
+		}
+	}
+	if ents, _ := img.Glob(`"DC6*",S`); len(ents) != 0 {
+		t.Error("type was not checked")
+	}
+}
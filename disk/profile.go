@@ -0,0 +1,248 @@
+package disk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// TrackOrder is the order in which a Profile fills the tracks of the disk.
+type TrackOrder int
+
+const (
+	// OrderROM works outward from the directory track like the DOS.
+	OrderROM TrackOrder = iota
+	// OrderAscending fills the disk from track 1 upwards.
+	OrderAscending
+)
+
+// TrackRange is an inclusive range of tracks.
+type TrackRange struct {
+	First, Last uint8
+}
+
+func (r TrackRange) Contains(t uint8) bool {
+	return r.First <= t && t <= r.Last
+}
+
+// Profile is a named allocation strategy. Different loaders read blocks at
+// different speeds, so each wants its own interleave: the DOS in the ROM is
+// fastest with 10 while many fast loaders want 3 to 6. A Profile implements
+// AllocStrategy. A profile in OrderROM without a StartTrack or Reserved tracks
+// allocates through ROMStrategy with its interleave.
+type Profile struct {
+	Name string
+	// Interleave is the number of sectors skipped between the blocks of a
+	// file.
+	Interleave uint8
+	Order TrackOrder
+	// StartTrack is the track the first block of a file is placed on, or the
+	// closest track after it with room. Zero uses the track order.
+	StartTrack uint8
+	// Reserved tracks are never allocated.
+	Reserved []TrackRange
+}
+
+var (
+	// ProfileROM lays out files like the 1541 DOS. It allocates exactly like
+	// ROMStrategy{SectorFileStagger}.
+	ProfileROM = Profile{Name: "rom", Interleave: SectorFileStagger, Order: OrderROM}
+	// ProfileContiguous puts the blocks of a file next to each other.
+	ProfileContiguous = Profile{Name: "contiguous", Interleave: 1, Order: OrderROM}
+	// ProfileFill fills the disk from track 1 with the interleave of the DOS.
+	ProfileFill = Profile{Name: "fill", Interleave: SectorFileStagger, Order: OrderAscending}
+)
+
+// LoaderProfile returns a profile for a fast loader which reads blocks best
+// with the given interleave.
+func LoaderProfile(interleave uint8) Profile {
+	return Profile{Name: fmt.Sprintf("il=%d", interleave), Interleave: interleave, Order: OrderROM}
+}
+
+// ParseProfile reads a profile from a comma separated list. The first item may
+// name a profile: "rom", "contiguous" or "fill". It defaults to "rom". The
+// items after it change the profile:
+//
+//	il=N       use an interleave of N sectors
+//	track=N    start files on track N
+//	reserve=A-B  never allocate tracks A to B (or reserve=A for one track)
+//
+// For example "fill,il=4,reserve=35".
+func ParseProfile(s string) (Profile, error) {
+	p := ProfileROM
+	items := strings.Split(s, ",")
+	switch items[0] {
+	case "", "rom":
+		items = items[1:]
+	case "contiguous":
+		p, items = ProfileContiguous, items[1:]
+	case "fill":
+		p, items = ProfileFill, items[1:]
+	}
+	p.Name = s
+	for _, item := range items {
+		key, val := cut(item, "=")
+		switch key {
+		case "il":
+			n, err := strconv.ParseUint(val, 10, 8)
+			if err != nil || n == 0 || n > 20 {
+				return p, fmt.Errorf("profile %s: bad interleave: %s", s, val)
+			}
+			p.Interleave = uint8(n)
+		case "track":
+			n, err := strconv.ParseUint(val, 10, 8)
+			if err != nil || n == 0 || n > totalTrackCount || n == bamTrack {
+				return p, fmt.Errorf("profile %s: bad start track: %s", s, val)
+			}
+			p.StartTrack = uint8(n)
+		case "reserve":
+			first, last := cut(val, "-")
+			if last == "" {
+				last = first
+			}
+			a, err1 := strconv.ParseUint(first, 10, 8)
+			b, err2 := strconv.ParseUint(last, 10, 8)
+			if err1 != nil || err2 != nil || a == 0 || b < a || b > totalTrackCount {
+				return p, fmt.Errorf("profile %s: bad track range: %s", s, val)
+			}
+			p.Reserved = append(p.Reserved, TrackRange{uint8(a), uint8(b)})
+		default:
+			return p, fmt.Errorf("profile %s: unknown setting: %s", s, item)
+		}
+	}
+	return p, nil
+}
+
+// cut splits s around the first sep. The second half is empty if sep is not
+// found.
+func cut(s, sep string) (string, string) {
+	if i := strings.Index(s, sep); i >= 0 {
+		return s[:i], s[i+len(sep):]
+	}
+	return s, ""
+}
+
+// usable checks if blocks may be taken from a track.
+func (p Profile) usable(bam *BAM, t uint8) bool {
+	if t == bamTrack || bam.TrackFree(t) == 0 {
+		return false
+	}
+	for _, r := range p.Reserved {
+		if r.Contains(t) {
+			return false
+		}
+	}
+	return true
+}
+
+// tracks lists every track in the order the profile fills them.
+func (p Profile) tracks() []uint8 {
+	var order []uint8
+	if p.Order == OrderAscending {
+		for t := uint8(1); t <= totalTrackCount; t++ {
+			order = append(order, t)
+		}
+		return order
+	}
+	for dist := uint8(1); dist < totalTrackCount; dist++ {
+		if dist < bamTrack {
+			order = append(order, bamTrack - dist)
+		}
+		if bamTrack + dist <= totalTrackCount {
+			order = append(order, bamTrack + dist)
+		}
+	}
+	return order
+}
+
+// rom returns the ROMStrategy the profile allocates like, if it is a plain
+// profile in OrderROM.
+func (p Profile) rom() (ROMStrategy, bool) {
+	plain := p.Order == OrderROM && p.StartTrack == 0 && len(p.Reserved) == 0
+	return ROMStrategy{p.Interleave}, plain
+}
+
+func (p Profile) First(bam *BAM) TS {
+	if r, ok := p.rom(); ok {
+		return r.First(bam)
+	}
+	if p.StartTrack != 0 {
+		for t := p.StartTrack; t <= totalTrackCount; t++ {
+			if p.usable(bam, t) {
+				return bam.firstFree(t, 0)
+			}
+		}
+	}
+	for _, t := range p.tracks() {
+		if p.usable(bam, t) {
+			return bam.firstFree(t, 0)
+		}
+	}
+	return TS{}
+}
+
+func (p Profile) Next(bam *BAM, prev TS) TS {
+	if r, ok := p.rom(); ok {
+		return r.Next(bam, prev)
+	}
+	t := prev.T
+	if p.usable(bam, t) {
+		return bam.firstFree(t, staggerSector(prev.S, p.Interleave, sectorCount(t)))
+	}
+	ok := func(t uint8) bool { return p.usable(bam, t) }
+	if p.Order == OrderROM {
+		t = romNextTrack(t, ok)
+	} else {
+		t = nextTrackAscending(t, ok)
+	}
+	if t == 0 {
+		// Whatever space is left is somewhere the track order has already
+		// passed, such as the tracks before StartTrack.
+		return p.First(bam)
+	}
+	return bam.firstFree(t, 0)
+}
+
+func nextTrackAscending(t uint8, ok func(uint8) bool) uint8 {
+	for t++; t <= totalTrackCount; t++ {
+		if ok(t) {
+			return t
+		}
+	}
+	return 0
+}
+
+// Interleave describes how the blocks of a file were laid out.
+type Interleave struct {
+	Name string
+	Blocks int
+	// Tracks counts the tracks the file is spread over. A track is counted
+	// again each time the file comes back to it.
+	Tracks int
+	// Gaps counts how often each distance in sectors occurs between blocks
+	// that follow each other on the same track.
+	Gaps map[int]int
+}
+
+// Interleaves reports the interleave that each file on the disk actually got,
+// in directory order.
+func (d *Img) Interleaves() []Interleave {
+	var report []Interleave
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		chain, _ := d.Chain(ent.FileTS)
+		il := Interleave{Name: ent.FilenameString(), Blocks: len(chain), Gaps: make(map[int]int)}
+		for i, ts := range chain {
+			if i == 0 || ts.T != chain[i-1].T {
+				il.Tracks++
+				continue
+			}
+			n := int(sectorCount(ts.T))
+			il.Gaps[(int(ts.S) - int(chain[i-1].S) + n) % n]++
+		}
+		report = append(report, il)
+	}
+	return report
+}
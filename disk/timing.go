@@ -0,0 +1,142 @@
+package disk
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// A sector on the disk is a sync mark and a header, a gap, then another sync
+// mark and the data block, all GCR encoded. The gaps between sectors take up
+// whatever is left of the track.
+const (
+	gcrSyncBytes = 5
+	gcrHeaderBytes = 10
+	gcrHeaderGap = 9
+	gcrDataBytes = 325
+	gcrSectorBytes = gcrSyncBytes + gcrHeaderBytes + gcrHeaderGap + gcrSyncBytes + gcrDataBytes
+
+	// The drive divides its 16 MHz clock by 13 to 16, depending on the speed
+	// zone, and writes a bit every 4 ticks.
+	driveClock = 16000000
+	// Disks are formatted at the nominal speed of the drive.
+	formatRPM = 300
+)
+
+// bitRate is the number of bits per second written on the tracks of the zone.
+func (g geom) bitRate() float64 {
+	return driveClock / float64(4 * (16 - int(g.speedZone)))
+}
+
+// trackBytes is the number of GCR encoded bytes that fit on one revolution of
+// a track when it is formatted.
+func (g geom) trackBytes() float64 {
+	return g.bitRate() / 8 * 60 / formatRPM
+}
+
+// TimingModel describes a drive and a loader closely enough to estimate how
+// long a file takes to load.
+type TimingModel struct {
+	// RPM is the rotation speed of the disk.
+	RPM float64
+	// StepTime is how long the head takes to move by one track, including
+	// the time it takes to settle.
+	StepTime time.Duration
+	// BlockCost is the time the loader spends on each block after reading it,
+	// transferring and decoding it, before it starts waiting for the next
+	// block.
+	BlockCost time.Duration
+}
+
+// DefaultTiming is a 1541 with a loader that spends 25ms on each block.
+var DefaultTiming = TimingModel{
+	RPM: 300,
+	StepTime: 12 * time.Millisecond,
+	BlockCost: 25 * time.Millisecond,
+}
+
+// Timing is the estimated time to load a file.
+type Timing struct {
+	Total time.Duration
+	Blocks int
+	// Tracks lists each track in the order the head visits it.
+	Tracks []TrackTiming
+}
+
+// TrackTiming is the time spent on one visit of the head to a track.
+type TrackTiming struct {
+	Track uint8
+	Blocks int
+	// Revolutions is the number of times the disk turned while the head was
+	// on the track.
+	Revolutions float64
+}
+
+// revolution is the time taken for one turn of the disk.
+func (m TimingModel) revolution() time.Duration {
+	return time.Duration(float64(time.Minute) / m.RPM)
+}
+
+// sectorTimes returns when a sector starts to pass under the head, relative to
+// the start of the track, and how long it takes to pass. Sectors are spread
+// evenly over the track, as the drive formats them.
+func (m TimingModel) sectorTimes(ts TS) (start, length time.Duration) {
+	g, err := geometry.Lookup(ts.T)
+	if err != nil {
+		panic(err)
+	}
+	rev := m.revolution()
+	start = rev * time.Duration(ts.S) / time.Duration(g.sectorCount)
+	length = time.Duration(float64(rev) * gcrSectorBytes / g.trackBytes())
+	return start, length
+}
+
+// Simulate follows a chain of blocks starting at ts and estimates how long it
+// takes to read them. The head starts on the directory track at the moment
+// sector 0 passes under it, the way it is left after the directory was
+// searched for the file.
+func (m TimingModel) Simulate(d *Img, ts TS) (Timing, error) {
+	var tm Timing
+	if !(m.RPM > 0) || math.IsInf(m.RPM, 0) {
+		return tm, fmt.Errorf("invalid RPM: %v", m.RPM)
+	}
+	chain, err := d.Chain(ts)
+	if err != nil {
+		return tm, err
+	}
+	rev := m.revolution()
+	var now time.Duration
+	head := uint8(bamTrack)
+	arrived := now
+	for i, ts := range chain {
+		if i == 0 || ts.T != head {
+			if len(tm.Tracks) > 0 {
+				tm.Tracks[len(tm.Tracks)-1].Revolutions = float64(now - arrived) / float64(rev)
+			}
+			steps := int(ts.T) - int(head)
+			if steps < 0 {
+				steps = -steps
+			}
+			now += m.StepTime * time.Duration(steps)
+			head, arrived = ts.T, now
+			tm.Tracks = append(tm.Tracks, TrackTiming{Track: ts.T})
+		}
+
+		// wait for the sector to come around, then read it
+		start, length := m.sectorTimes(ts)
+		wait := (start - now % rev + rev) % rev
+		now += wait + length + m.BlockCost
+		tm.Tracks[len(tm.Tracks)-1].Blocks++
+		tm.Blocks++
+	}
+	if len(tm.Tracks) > 0 {
+		tm.Tracks[len(tm.Tracks)-1].Revolutions = float64(now - arrived) / float64(rev)
+	}
+	tm.Total = now
+	return tm, nil
+}
+
+// File estimates how long it takes to load a file.
+func (m TimingModel) File(d *Img, ent *DirEntry) (Timing, error) {
+	return m.Simulate(d, ent.FileTS)
+}
@@ -0,0 +1,62 @@
+package disk
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestTiming(t *testing.T) {
+	var d Img
+	d.Init("TIMING", "01")
+	data := make([]byte, 21 * 254)
+	rom, _ := d.WriteFile("ROM", PRG, data, &WriteOptions{Strategy: ProfileROM})
+	tight, _ := d.WriteFile("TIGHT", PRG, data, &WriteOptions{Strategy: ProfileContiguous})
+	loader, _ := d.WriteFile("LOADER", PRG, data, &WriteOptions{Strategy: LoaderProfile(4)})
+
+	model := DefaultTiming
+	slow, err := model.File(&d, rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if slow.Blocks != 21 || len(slow.Tracks) != 1 || slow.Tracks[0].Track != 17 {
+		t.Errorf("wrong layout: %+v", slow)
+	}
+	// A block takes a little under 10ms to pass under the head, so with an
+	// interleave of 10 each block costs about half a revolution.
+	if revs := slow.Tracks[0].Revolutions; revs < 9 || revs > 12 {
+		t.Error("unexpected revolutions:", revs)
+	}
+	// The contiguous file misses every next block while the loader is busy.
+	missed, _ := model.File(&d, tight)
+	fast, _ := model.File(&d, loader)
+	if fast.Total >= slow.Total || fast.Total >= missed.Total {
+		t.Errorf("expected interleave 4 to suit the loader best: %v %v %v", slow.Total, missed.Total, fast.Total)
+	}
+
+	model.BlockCost = 0
+	fast, _ = model.File(&d, tight)
+	slow, _ = model.File(&d, loader)
+	if fast.Total >= slow.Total {
+		t.Error("expected the contiguous file to load fastest without any cost per block")
+	}
+
+	// The bit rate of the speed zones fits 7692 bytes on the outer tracks
+	// and 6250 on the inner ones.
+	for _, tc := range []struct{ ts TS; length time.Duration }{
+		{TS{1, 0}, 9204 * time.Microsecond},
+		{TS{35, 0}, 11328 * time.Microsecond},
+	} {
+		_, length := DefaultTiming.sectorTimes(tc.ts)
+		if d := length - tc.length; d < -time.Microsecond || d > time.Microsecond {
+			t.Errorf("track %d: a sector takes %v to pass", tc.ts.T, length)
+		}
+	}
+
+	for _, rpm := range []float64{0, -300, math.NaN(), math.Inf(1)} {
+		model.RPM = rpm
+		if _, err := model.File(&d, tight); err == nil {
+			t.Errorf("RPM %v was accepted", rpm)
+		}
+	}
+}
@@ -0,0 +1,212 @@
+package disk
+
+import (
+	"errors"
+)
+
+// Scratching a file only clears its file type byte and frees its blocks in the
+// BAM. The rest of the directory entry and the block chain stay on the disk
+// until something else is written over them.
+
+var (
+	NotScratched = errors.New("directory entry is not scratched")
+	ChainClash = errors.New("block chain overlaps blocks in use")
+)
+
+// Recoverable is a scratched directory entry whose block chain is still intact.
+type Recoverable struct {
+	Entry *DirEntry
+	Blocks []TS
+	// Type is the guessed file type of the entry.
+	Type FileType
+}
+
+// usedBlocks collects every block that is referenced by the BAM, the directory
+// or the chain of a file which is not scratched.
+func (d *Img) usedBlocks() map[TS]bool {
+	used := map[TS]bool{{bamTrack, 0}: true}
+	dirChain, _ := d.Chain(d.BAM().DirTS)
+	for _, ts := range dirChain {
+		used[ts] = true
+	}
+	for _, ent := range d.DirEntries() {
+		if ent.IsScratched() {
+			continue
+		}
+		chain, _ := d.Chain(ent.FileTS)
+		for _, ts := range chain {
+			used[ts] = true
+		}
+	}
+	return used
+}
+
+// intactChain checks that the chain starting at ts is intact and that none of its
+// blocks are used by another file. Blocks that are allocated in the BAM
+// without belonging to anything are not a clash.
+func (d *Img) intactChain(ts TS, used map[TS]bool) ([]TS, error) {
+	if ts.T == 0 {
+		return nil, BadTS
+	}
+	chain, err := d.Chain(ts)
+	if err != nil {
+		return nil, err
+	}
+	for _, ts := range chain {
+		if used[ts] {
+			return nil, ChainClash
+		}
+	}
+	last := (*RawBlock)(d.Block(chain[len(chain)-1]))
+	if last.Link.S == 0 {
+		// an empty last block is not something the DOS writes
+		return nil, BadTS
+	}
+	return chain, nil
+}
+
+// Recoverable lists the scratched directory entries which can still be
+// undeleted.
+func (d *Img) Recoverable() []Recoverable {
+	var list []Recoverable
+	used := d.usedBlocks()
+	for _, ent := range d.DirEntries() {
+		if !ent.IsScratched() || ent.FileTS.IsNull() {
+			continue
+		}
+		chain, err := d.intactChain(ent.FileTS, used)
+		if err != nil {
+			continue
+		}
+		list = append(list, Recoverable{ent, chain, d.guessFileType(chain[0])})
+	}
+	return list
+}
+
+// Undelete restores a scratched directory entry and marks its blocks as
+// allocated in the BAM. When typ is 0 the file type is guessed from the
+// contents of the first block.
+func (d *Img) Undelete(ent *DirEntry, typ FileType) error {
+	if !ent.IsScratched() {
+		return NotScratched
+	}
+	chain, err := d.intactChain(ent.FileTS, d.usedBlocks())
+	if err != nil {
+		return err
+	}
+	if typ == 0 {
+		typ = d.guessFileType(chain[0])
+	}
+	if err = d.allocChain(chain); err != nil {
+		return err
+	}
+	ent.FileType = typ
+	ent.SetBlockCount(uint16(len(chain)))
+	return nil
+}
+
+// allocChain marks the blocks of a chain which are still free as allocated.
+func (d *Img) allocChain(chain []TS) error {
+	bam := d.BAM()
+	var taken []TS
+	for _, ts := range chain {
+		if !bam.Avail(ts) {
+			continue
+		}
+		if err := bam.Alloc(ts); err != nil {
+			// undo the blocks allocated so far
+			for _, ts := range taken {
+				bam.Free(ts)
+			}
+			return err
+		}
+		taken = append(taken, ts)
+	}
+	return nil
+}
+
+// guessFileType assumes a file is SEQ if its first block looks like PETSCII
+// text and otherwise that it is a PRG.
+func (d *Img) guessFileType(ts TS) FileType {
+	for _, c := range (*RawBlock)(d.Block(ts)).Bytes() {
+		switch {
+		case c == 0x0D, 0x20 <= c && c < 0x80, 0xA0 <= c:
+		default:
+			return PRG
+		}
+	}
+	return SEQ
+}
+
+// Orphans scans the disk for block chains that are not referenced by any
+// directory entry, scratched or not, and which do not overlap blocks in use.
+// The directory track is never scanned.
+func (d *Img) Orphans() [][]TS {
+	used := d.usedBlocks()
+	for _, ent := range d.DirEntries() {
+		if !ent.IsScratched() || ent.FileTS.IsNull() {
+			continue
+		}
+		chain, _ := d.Chain(ent.FileTS)
+		for _, ts := range chain {
+			used[ts] = true
+		}
+	}
+
+	// Every candidate that is linked to from another candidate is not the
+	// head of a chain.
+	var candidates []TS
+	linked := make(map[TS]bool)
+	for t := uint8(1); t <= totalTrackCount; t++ {
+		if t == bamTrack {
+			continue
+		}
+		for s := uint8(0); s < sectorCount(t); s++ {
+			ts := TS{t, s}
+			blk := (*RawBlock)(d.Block(ts))
+			if used[ts] || blk.Link == (TS{}) {
+				continue
+			}
+			candidates = append(candidates, ts)
+			if !blk.EOF() {
+				linked[blk.Link] = true
+			}
+		}
+	}
+
+	var orphans [][]TS
+	for _, ts := range candidates {
+		if linked[ts] {
+			continue
+		}
+		chain, err := d.intactChain(ts, used)
+		if err != nil {
+			continue
+		}
+		orphans = append(orphans, chain)
+	}
+	return orphans
+}
+
+// Adopt creates a new directory entry for an orphaned chain starting at ts and
+// marks its blocks as allocated in the BAM.
+func (d *Img) Adopt(ts TS, name string, typ FileType) (*DirEntry, error) {
+	chain, err := d.intactChain(ts, d.usedBlocks())
+	if err != nil {
+		return nil, err
+	}
+	if typ == 0 {
+		typ = d.guessFileType(ts)
+	}
+	ent, err := d.NewDirEntry()
+	if err != nil {
+		return nil, err
+	}
+	if err = d.allocChain(chain); err != nil {
+		return nil, err
+	}
+	*ent = DirEntry{DirLink: ent.DirLink, FileType: typ, FileTS: ts}
+	ent.SetFilename(name)
+	ent.SetBlockCount(uint16(len(chain)))
+	return ent, nil
+}
@@ -0,0 +1,277 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// WritableFS is a file system whose files can be changed, in the style of
+// io/fs. Errors are *fs.PathError holding a *DOSError, which matches both the
+// errors of this package, such as DiskFull or DirFull, and the errors of io/fs
+// that mean the same, such as fs.ErrExist.
+type WritableFS interface {
+	fs.FS
+	// Create creates or truncates a file.
+	Create(name string) (WritableFile, error)
+	// OpenFile opens a file with the flags of os.OpenFile. The perm of a new
+	// file chooses its type when the name has none: PRG if it is executable
+	// and SEQ otherwise. A new file without write permission is locked.
+	OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error)
+	Remove(name string) error
+	// Rename changes the name of a file, and its type if the new name has
+	// another type as its extension. The file stays in the same directory.
+	Rename(oldname, newname string) error
+	// Chmod locks a file when mode has no write permission and unlocks it
+	// otherwise.
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// WritableFile is a file opened for writing. The contents are stored on the
+// disk when it is closed, so Close reports when the disk is full.
+type WritableFile interface {
+	fs.File
+	io.Writer
+}
+
+// WritableFS returns a writable file system holding the files of the disk,
+// with the same layout as FS.
+func (d *Img) WritableFS(opts ...FSOption) WritableFS {
+	return d.FS(opts...).(*diskFS)
+}
+
+func pathError(op, name string, err error) error {
+	return &fs.PathError{Op: op, Path: name, Err: toDOSError(err)}
+}
+
+// cbmName is a path converted back to a name and type on the disk.
+type cbmName struct {
+	name string
+	// typ is 0 when the path has no type.
+	typ FileType
+	// file is the existing file with the path, if there is one.
+	file *fsFile
+}
+
+// parseName converts a path of the file system to the name of a file on the
+// disk and the type its extension gives.
+func (dfs *diskFS) parseName(name string) (cbmName, error) {
+	var cn cbmName
+	if !fs.ValidPath(name) {
+		return cn, errors.New("invalid path")
+	}
+	f, ok := dfs.lookup(name)
+	if ok && f == nil {
+		// a directory
+		return cn, FileExists
+	}
+	cn.file = f
+
+	dir, file := path.Split(name)
+	if root := dfs.dirName(); dir != "" && dir != root+"/" || dir == "" && root != "" {
+		return cn, FileNotFound
+	}
+	stem, ext := file, path.Ext(file)
+	switch dfs.conf.ext {
+	case ExtType:
+		if typ, err := ParseFileType(strings.TrimPrefix(ext, ".")); err == nil {
+			stem, cn.typ = strings.TrimSuffix(file, ext), typ
+		}
+	case ExtP00:
+		if len(ext) == 4 {
+			for i, s := range fileTypeNames {
+				if ext[1] == s[0] || ext[1] == s[0]-'A'+'a' {
+					stem, cn.typ = strings.TrimSuffix(file, ext), DEL+FileType(i)
+				}
+			}
+		}
+	}
+
+	raw := []byte(stem)
+	if dfs.conf.names == NameEscape {
+		raw = raw[:0]
+		for i := 0; i < len(stem); i++ {
+			if stem[i] == '%' && i+2 < len(stem) {
+				if c, err := strconv.ParseUint(stem[i+1:i+3], 16, 8); err == nil {
+					raw = append(raw, byte(c))
+					i += 2
+					continue
+				}
+			}
+			raw = append(raw, stem[i])
+		}
+	}
+	if len(raw) == 0 || len(raw) > len(DirEntry{}.Filename) {
+		return cn, errors.New("bad file name")
+	}
+	cn.name = string(raw)
+	return cn, nil
+}
+
+// entryNamed returns the directory entry of an existing file, even when another
+// path names it.
+func (d *Img) entryNamed(cn cbmName) *DirEntry {
+	if cn.file != nil {
+		return cn.file.entry
+	}
+	return d.Lookup(cn.name)
+}
+
+func (dfs *diskFS) Create(name string) (WritableFile, error) {
+	f, err := dfs.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return f.(WritableFile), nil
+}
+
+func (dfs *diskFS) OpenFile(name string, flag int, perm fs.FileMode) (fs.File, error) {
+	if flag&(os.O_WRONLY|os.O_RDWR) == 0 {
+		return dfs.Open(name)
+	}
+	cn, err := dfs.parseName(name)
+	if err != nil {
+		return nil, pathError("open", name, err)
+	}
+	ent := dfs.disk.entryNamed(cn)
+	wf := &writeFile{dfs: dfs, path: name, name: cn.name, typ: cn.typ}
+	switch {
+	case ent == nil && flag&os.O_CREATE == 0:
+		return nil, pathError("open", name, FileNotFound)
+	case ent == nil:
+		if wf.typ == 0 {
+			wf.typ = SEQ
+			if perm&0111 != 0 {
+				wf.typ = PRG
+			}
+		}
+		wf.locked = perm&0222 == 0
+	case flag&os.O_EXCL != 0:
+		return nil, pathError("open", name, FileExists)
+	case ent.FileType.Locked():
+		return nil, pathError("open", name, FileLocked)
+	case flag&(os.O_TRUNC|os.O_APPEND) == 0:
+		// the blocks of a file can not be overwritten in place
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	default:
+		wf.name, wf.replace = UnpadBytes(ent.Filename[:]), true
+		if wf.typ == 0 {
+			wf.typ = ent.FileType.Base()
+		}
+		if flag&os.O_APPEND != 0 {
+			if wf.buf, err = dfs.disk.ReadFile(ent); err != nil {
+				return nil, pathError("open", name, err)
+			}
+		}
+	}
+	return wf, nil
+}
+
+func (dfs *diskFS) Remove(name string) error {
+	cn, err := dfs.parseName(name)
+	if err != nil {
+		return pathError("remove", name, err)
+	}
+	ent := dfs.disk.entryNamed(cn)
+	switch {
+	case ent == nil:
+		return pathError("remove", name, FileNotFound)
+	case ent.FileType.Locked():
+		return pathError("remove", name, FileLocked)
+	}
+	dfs.disk.scratch(ent)
+	return nil
+}
+
+func (dfs *diskFS) Rename(oldname, newname string) error {
+	oldcn, err := dfs.parseName(oldname)
+	if err != nil {
+		return pathError("rename", oldname, err)
+	}
+	ent := dfs.disk.entryNamed(oldcn)
+	if ent == nil {
+		return pathError("rename", oldname, FileNotFound)
+	}
+	newcn, err := dfs.parseName(newname)
+	if err != nil {
+		return pathError("rename", newname, err)
+	}
+	if other := dfs.disk.entryNamed(newcn); other != nil && other != ent {
+		return pathError("rename", newname, FileExists)
+	}
+	ent.SetRawName([]byte(newcn.name))
+	if newcn.typ != 0 {
+		ent.FileType = newcn.typ | ent.FileType&^7
+	}
+	return nil
+}
+
+func (dfs *diskFS) Chmod(name string, mode fs.FileMode) error {
+	cn, err := dfs.parseName(name)
+	if err != nil {
+		return pathError("chmod", name, err)
+	}
+	ent := dfs.disk.entryNamed(cn)
+	if ent == nil {
+		return pathError("chmod", name, FileNotFound)
+	}
+	ent.FileType = ent.FileType.Set(FlagLocked, mode&0222 == 0)
+	return nil
+}
+
+// writeFile collects what is written to a file and stores it when it is
+// closed.
+type writeFile struct {
+	dfs *diskFS
+	path string
+	name string
+	typ FileType
+	locked bool
+	replace bool
+	buf []byte
+	closed bool
+}
+
+func (wf *writeFile) Write(p []byte) (int, error) {
+	if wf.closed {
+		return 0, &fs.PathError{Op: "write", Path: wf.path, Err: fs.ErrClosed}
+	}
+	wf.buf = append(wf.buf, p...)
+	return len(p), nil
+}
+
+func (wf *writeFile) Read(_ []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: wf.path, Err: fs.ErrInvalid}
+}
+
+func (wf *writeFile) Stat() (fs.FileInfo, error) {
+	f := &fsFile{name: path.Base(wf.path), entry: &DirEntry{FileType: wf.typ}}
+	if wf.locked {
+		f.entry.FileType |= FlagLocked
+	}
+	return &fileInfo{f, int64(len(wf.buf))}, nil
+}
+
+func (wf *writeFile) Close() error {
+	if wf.closed {
+		return &fs.PathError{Op: "close", Path: wf.path, Err: fs.ErrClosed}
+	}
+	wf.closed = true
+	data := wf.buf
+	if wf.dfs.conf.ext == ExtP00 && len(data) >= len(p00Magic)+18 && bytes.HasPrefix(data, []byte(p00Magic)) {
+		data = data[len(p00Magic)+18:]
+	}
+	ent, err := wf.dfs.disk.WriteFile(wf.name, wf.typ, data, &WriteOptions{Replace: wf.replace})
+	if err != nil {
+		return pathError("close", wf.path, err)
+	}
+	if wf.locked {
+		ent.FileType |= FlagLocked
+	}
+	return nil
+}